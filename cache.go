@@ -0,0 +1,470 @@
+package quickstore
+
+import (
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// promoteBufSize bounds the cache hits waiting to refresh their recency. Hits beyond it are dropped,
+// which only makes the eviction order less precise.
+const promoteBufSize = 1024
+
+// Cache holds the entries of a node and decides which one to evict when it is full. A cache is only used under
+// the lock of its node, so it needs not be safe for concurrent use. It must call the eviction callback it was
+// created with for every entry it evicts, but not for the entries removed with Remove.
+type Cache interface {
+	Add(key Key, value interface{})
+	// Get returns the value of key and records the access.
+	Get(key Key) (interface{}, bool)
+	// Peek returns the value of key without recording the access.
+	Peek(key Key) (interface{}, bool)
+	Remove(key Key)
+	Keys() []Key
+	Len() int
+}
+
+// CacheFactory creates the cache of a node, holding at most size entries.
+type CacheFactory func(size int, onEvict func(key Key)) (Cache, error)
+
+// lruCache evicts the least recently used entry.
+type lruCache struct {
+	size    int
+	lru     *simplelru.LRU
+	onEvict func(Key)
+}
+
+// NewLRUCache creates a cache evicting the least recently used entry. It is the default.
+func NewLRUCache(size int, onEvict func(key Key)) (Cache, error) {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &lruCache{size: size, lru: lru, onEvict: onEvict}, nil
+}
+
+func (c *lruCache) Add(key Key, value interface{}) {
+	if !c.lru.Contains(key) && c.lru.Len() >= c.size {
+		evicted, _, _ := c.lru.RemoveOldest()
+		c.onEvict(evicted.(Key))
+	}
+	c.lru.Add(key, value)
+}
+
+func (c *lruCache) Get(key Key) (interface{}, bool) {
+	return c.lru.Get(key)
+}
+
+func (c *lruCache) Peek(key Key) (interface{}, bool) {
+	return c.lru.Peek(key)
+}
+
+func (c *lruCache) Remove(key Key) {
+	c.lru.Remove(key)
+}
+
+func (c *lruCache) Keys() []Key {
+	return keysOf(c.lru)
+}
+
+func (c *lruCache) Len() int {
+	return c.lru.Len()
+}
+
+const (
+	twoQueueRecentRatio = 0.25
+	twoQueueGhostRatio  = 0.5
+)
+
+// twoQueueCache implements 2Q: new entries enter a small recent queue, and only entries accessed again, or
+// added again soon after their eviction, reach the frequent queue. A scan of cold keys thus only churns
+// the recent queue.
+//
+// 2Q and ARC are built on simplelru rather than taken from golang-lru, whose TwoQueueCache and ARCCache take
+// no eviction callback in v0.5.4. The node cache relies on that callback to pin dirty entries and keep its
+// lock-free copy of the entries in sync.
+type twoQueueCache struct {
+	size       int
+	recentSize int
+	recent     *simplelru.LRU
+	frequent   *simplelru.LRU
+	// ghosts remembers the keys recently evicted from recent, without their values.
+	ghosts  *simplelru.LRU
+	onEvict func(Key)
+}
+
+// New2QCache creates a cache resisting scans with the 2Q policy.
+func New2QCache(size int, onEvict func(key Key)) (Cache, error) {
+	ghostSize := int(float64(size) * twoQueueGhostRatio)
+	if ghostSize < 1 {
+		ghostSize = 1
+	}
+	recent, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	frequent, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	ghosts, err := simplelru.NewLRU(ghostSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &twoQueueCache{
+		size:       size,
+		recentSize: int(float64(size) * twoQueueRecentRatio),
+		recent:     recent,
+		frequent:   frequent,
+		ghosts:     ghosts,
+		onEvict:    onEvict,
+	}, nil
+}
+
+func (c *twoQueueCache) Add(key Key, value interface{}) {
+	if c.frequent.Contains(key) {
+		c.frequent.Add(key, value)
+		return
+	}
+	if c.recent.Contains(key) {
+		c.recent.Remove(key)
+		c.frequent.Add(key, value)
+		return
+	}
+	if c.ghosts.Contains(key) {
+		c.evict(true)
+		c.ghosts.Remove(key)
+		c.frequent.Add(key, value)
+		return
+	}
+	c.evict(false)
+	c.recent.Add(key, value)
+}
+
+// evict makes room for one entry, preferring to evict from recent while it is over its share.
+func (c *twoQueueCache) evict(ghost bool) {
+	recentLen := c.recent.Len()
+	if recentLen+c.frequent.Len() < c.size {
+		return
+	}
+	if recentLen > 0 && (recentLen > c.recentSize || (recentLen == c.recentSize && !ghost)) {
+		evicted, _, _ := c.recent.RemoveOldest()
+		c.ghosts.Add(evicted, nil)
+		c.onEvict(evicted.(Key))
+		return
+	}
+	evicted, _, _ := c.frequent.RemoveOldest()
+	c.onEvict(evicted.(Key))
+}
+
+func (c *twoQueueCache) Get(key Key) (interface{}, bool) {
+	if value, ok := c.frequent.Get(key); ok {
+		return value, true
+	}
+	if value, ok := c.recent.Peek(key); ok {
+		c.recent.Remove(key)
+		c.frequent.Add(key, value)
+		return value, true
+	}
+	return nil, false
+}
+
+func (c *twoQueueCache) Peek(key Key) (interface{}, bool) {
+	if value, ok := c.frequent.Peek(key); ok {
+		return value, true
+	}
+	return c.recent.Peek(key)
+}
+
+func (c *twoQueueCache) Remove(key Key) {
+	if c.frequent.Remove(key) || c.recent.Remove(key) {
+		return
+	}
+	c.ghosts.Remove(key)
+}
+
+func (c *twoQueueCache) Keys() []Key {
+	return append(keysOf(c.frequent), keysOf(c.recent)...)
+}
+
+func (c *twoQueueCache) Len() int {
+	return c.recent.Len() + c.frequent.Len()
+}
+
+// arcCache implements the Adaptive Replacement Cache: like 2Q it splits entries seen once (t1) from entries
+// seen again (t2), but it adapts the share p of t1 by tracking the keys recently evicted from each (b1 and b2).
+type arcCache struct {
+	size    int
+	p       int
+	t1, t2  *simplelru.LRU
+	b1, b2  *simplelru.LRU
+	onEvict func(Key)
+}
+
+// NewARCCache creates a cache resisting scans with the ARC policy.
+func NewARCCache(size int, onEvict func(key Key)) (Cache, error) {
+	c := &arcCache{size: size, onEvict: onEvict}
+	for _, lru := range []**simplelru.LRU{&c.t1, &c.t2, &c.b1, &c.b2} {
+		var err error
+		*lru, err = simplelru.NewLRU(size, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *arcCache) Add(key Key, value interface{}) {
+	if c.t1.Contains(key) {
+		c.t1.Remove(key)
+		c.t2.Add(key, value)
+		return
+	}
+	if c.t2.Contains(key) {
+		c.t2.Add(key, value)
+		return
+	}
+	if c.b1.Contains(key) {
+		// A hit in b1 means t1 was too small.
+		delta := 1
+		if c.b2.Len() > c.b1.Len() {
+			delta = c.b2.Len() / c.b1.Len()
+		}
+		c.p += delta
+		if c.p > c.size {
+			c.p = c.size
+		}
+		if c.t1.Len()+c.t2.Len() >= c.size {
+			c.replace(false)
+		}
+		c.b1.Remove(key)
+		c.t2.Add(key, value)
+		return
+	}
+	if c.b2.Contains(key) {
+		// A hit in b2 means t2 was too small.
+		delta := 1
+		if c.b1.Len() > c.b2.Len() {
+			delta = c.b1.Len() / c.b2.Len()
+		}
+		c.p -= delta
+		if c.p < 0 {
+			c.p = 0
+		}
+		if c.t1.Len()+c.t2.Len() >= c.size {
+			c.replace(true)
+		}
+		c.b2.Remove(key)
+		c.t2.Add(key, value)
+		return
+	}
+	if c.t1.Len()+c.t2.Len() >= c.size {
+		c.replace(false)
+	}
+	if c.b1.Len() > c.size-c.p {
+		c.b1.RemoveOldest()
+	}
+	if c.b2.Len() > c.p {
+		c.b2.RemoveOldest()
+	}
+	c.t1.Add(key, value)
+}
+
+// replace evicts from t1 while it is over its target size p, from t2 otherwise. When t2 is empty, it evicts from t1
+// regardless, or t1 would drop its oldest entry without the eviction callback.
+func (c *arcCache) replace(inB2 bool) {
+	t1Len := c.t1.Len()
+	if t1Len > 0 && (t1Len > c.p || (t1Len == c.p && inB2) || c.t2.Len() == 0) {
+		evicted, _, _ := c.t1.RemoveOldest()
+		c.b1.Add(evicted, nil)
+		c.onEvict(evicted.(Key))
+		return
+	}
+	evicted, _, ok := c.t2.RemoveOldest()
+	if ok {
+		c.b2.Add(evicted, nil)
+		c.onEvict(evicted.(Key))
+	}
+}
+
+func (c *arcCache) Get(key Key) (interface{}, bool) {
+	if value, ok := c.t1.Peek(key); ok {
+		c.t1.Remove(key)
+		c.t2.Add(key, value)
+		return value, true
+	}
+	return c.t2.Get(key)
+}
+
+func (c *arcCache) Peek(key Key) (interface{}, bool) {
+	if value, ok := c.t1.Peek(key); ok {
+		return value, true
+	}
+	return c.t2.Peek(key)
+}
+
+func (c *arcCache) Remove(key Key) {
+	if c.t1.Remove(key) || c.t2.Remove(key) || c.b1.Remove(key) {
+		return
+	}
+	c.b2.Remove(key)
+}
+
+func (c *arcCache) Keys() []Key {
+	return append(keysOf(c.t1), keysOf(c.t2)...)
+}
+
+func (c *arcCache) Len() int {
+	return c.t1.Len() + c.t2.Len()
+}
+
+func keysOf(lru *simplelru.LRU) []Key {
+	keys := make([]Key, 0, lru.Len())
+	for _, key := range lru.Keys() {
+		keys = append(keys, key.(Key))
+	}
+	return keys
+}
+
+// nodeCache is the cache of a node. Every method but load must be called with the lock of the node held.
+//
+// Reads of cached entries go through load, which reads a copy of the entries held in a sync.Map and takes
+// no lock, so that cache hits scale with the readers. Hits cannot refresh the recency of the cache without
+// its lock, so they are buffered and replayed the next time the lock is held, before anything is evicted.
+//
+// Entries with a mutation not flushed yet are dirty: reading them from DynamoDB would return an older value.
+// When the cache evicts a dirty entry it is pinned instead, and only dropped once its mutation is flushed.
+type nodeCache struct {
+	cache   Cache
+	entries sync.Map
+	promote chan Key
+	// dirty holds the sequence number of the last mutation of each dirty key.
+	dirty  map[Key]Seq
+	pinned map[Key]cacheValue
+	// overflow is called with the number of pinned entries each time one is pinned.
+	overflow func(pinned int)
+}
+
+func newNodeCache(size int, factory CacheFactory, overflow func(pinned int)) (*nodeCache, error) {
+	c := &nodeCache{
+		promote:  make(chan Key, promoteBufSize),
+		dirty:    make(map[Key]Seq),
+		pinned:   make(map[Key]cacheValue),
+		overflow: overflow,
+	}
+	cache, err := factory(size, c.evict)
+	if err != nil {
+		return nil, err
+	}
+	c.cache = cache
+	return c, nil
+}
+
+func (c *nodeCache) evict(key Key) {
+	if _, ok := c.dirty[key]; !ok {
+		c.entries.Delete(key)
+		return
+	}
+	value, _ := c.entries.Load(key)
+	c.pinned[key] = value.(cacheValue)
+	if c.overflow != nil {
+		c.overflow(len(c.pinned))
+	}
+}
+
+// load returns the entry of key without locking.
+func (c *nodeCache) load(key Key) (cacheValue, bool) {
+	value, ok := c.entries.Load(key)
+	if !ok {
+		return cacheValue{}, false
+	}
+	select {
+	case c.promote <- key:
+	default:
+	}
+	return value.(cacheValue), true
+}
+
+func (c *nodeCache) Get(key Key) (cacheValue, bool) {
+	c.replay()
+	value, ok := c.cache.Get(key)
+	if !ok {
+		value, ok := c.pinned[key]
+		return value, ok
+	}
+	return value.(cacheValue), true
+}
+
+// Peek returns the entry of key without refreshing its recency.
+func (c *nodeCache) Peek(key Key) (cacheValue, bool) {
+	value, ok := c.cache.Peek(key)
+	if !ok {
+		value, ok := c.pinned[key]
+		return value, ok
+	}
+	return value.(cacheValue), true
+}
+
+func (c *nodeCache) Add(key Key, value cacheValue) {
+	c.replay()
+	delete(c.pinned, key)
+	c.entries.Store(key, value)
+	c.cache.Add(key, value)
+}
+
+// Remove drops the entry of key, even if it is dirty.
+func (c *nodeCache) Remove(key Key) {
+	c.cache.Remove(key)
+	delete(c.dirty, key)
+	delete(c.pinned, key)
+	c.entries.Delete(key)
+}
+
+func (c *nodeCache) Keys() []Key {
+	keys := c.cache.Keys()
+	for key := range c.pinned {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// markDirty records that the entry of key holds the mutation seq, which is not flushed yet.
+func (c *nodeCache) markDirty(key Key, seq Seq) {
+	c.dirty[key] = seq
+}
+
+func (c *nodeCache) isDirty(key Key) bool {
+	_, ok := c.dirty[key]
+	return ok
+}
+
+// dirtyAfter reports whether key has a mutation after seq which is not flushed yet.
+func (c *nodeCache) dirtyAfter(key Key, seq Seq) bool {
+	last, ok := c.dirty[key]
+	return ok && last > seq
+}
+
+// markFlushed records that the mutation seq of key is flushed. The entry is clean unless a later mutation
+// of key is pending, and it is dropped if it was pinned.
+func (c *nodeCache) markFlushed(key Key, seq Seq) {
+	if c.dirtyAfter(key, seq) {
+		return
+	}
+	delete(c.dirty, key)
+	if _, ok := c.pinned[key]; ok {
+		delete(c.pinned, key)
+		c.entries.Delete(key)
+	}
+}
+
+// replay records the accesses of the entries hit through load.
+func (c *nodeCache) replay() {
+	for {
+		select {
+		case key := <-c.promote:
+			c.cache.Get(key)
+		default:
+			return
+		}
+	}
+}
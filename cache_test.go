@@ -0,0 +1,208 @@
+package quickstore
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeCache(t *testing.T) {
+	c, err := newNodeCache(2, NewLRUCache, nil)
+	assert.NoError(t, err)
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+	d := Key{Kind: "itm", Identifier: "d"}
+
+	c.Add(a, cacheValue{state: stateExist})
+	c.Add(b, cacheValue{state: stateNotExist})
+	value, ok := c.load(b)
+	assert.True(t, ok)
+	assert.Equal(t, stateNotExist, value.state)
+
+	// The hit on a is replayed before d is added, so b is the least recently used.
+	_, ok = c.load(a)
+	assert.True(t, ok)
+	c.Add(d, cacheValue{state: stateExist})
+	_, ok = c.load(b)
+	assert.False(t, ok)
+	_, ok = c.load(a)
+	assert.True(t, ok)
+
+	c.Remove(a)
+	_, ok = c.load(a)
+	assert.False(t, ok)
+	assert.Equal(t, []Key{d}, c.Keys())
+}
+
+func TestNodeCache_ScanResistance(t *testing.T) {
+	policies := map[string]CacheFactory{"2Q": New2QCache, "ARC": NewARCCache}
+	for name, factory := range policies {
+		t.Run(name, func(t *testing.T) {
+			c, err := newNodeCache(8, factory, nil)
+			assert.NoError(t, err)
+			hot := []Key{{Kind: "itm", Identifier: "a"}, {Kind: "itm", Identifier: "b"}}
+			for _, key := range hot {
+				c.Add(key, cacheValue{state: stateExist})
+				c.Get(key)
+			}
+
+			for i := 0; i < 100; i++ {
+				c.Add(Key{Kind: "itm", Identifier: strconv.Itoa(i)}, cacheValue{state: stateExist})
+			}
+			for _, key := range hot {
+				_, ok := c.load(key)
+				assert.True(t, ok)
+			}
+
+			// Evicted entries leave the lock-free copy too.
+			assert.Len(t, c.Keys(), 8)
+			count := 0
+			c.entries.Range(func(_, _ interface{}) bool {
+				count++
+				return true
+			})
+			assert.Equal(t, 8, count)
+		})
+	}
+}
+
+func TestNodeCache_PinsDirty(t *testing.T) {
+	var overflows []int
+	c, err := newNodeCache(1, NewLRUCache, func(pinned int) {
+		overflows = append(overflows, pinned)
+	})
+	assert.NoError(t, err)
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+	d := Key{Kind: "itm", Identifier: "d"}
+
+	c.markDirty(a, 1)
+	c.Add(a, cacheValue{state: stateExist})
+	c.markDirty(a, 2)
+	c.Add(a, cacheValue{state: stateNotExist})
+	c.Add(b, cacheValue{state: stateExist})
+	c.Add(d, cacheValue{state: stateExist})
+	assert.Equal(t, []int{1}, overflows)
+
+	// a is evicted but its mutations are pending, b is evicted for good.
+	value, ok := c.load(a)
+	assert.True(t, ok)
+	assert.Equal(t, stateNotExist, value.state)
+	value, ok = c.Get(a)
+	assert.True(t, ok)
+	assert.Equal(t, stateNotExist, value.state)
+	_, ok = c.load(b)
+	assert.False(t, ok)
+	assert.ElementsMatch(t, []Key{a, d}, c.Keys())
+
+	c.markFlushed(a, 1)
+	_, ok = c.load(a)
+	assert.True(t, ok)
+	c.markFlushed(a, 2)
+	_, ok = c.load(a)
+	assert.False(t, ok)
+	assert.Equal(t, []Key{d}, c.Keys())
+}
+
+func TestTwoQueueCache(t *testing.T) {
+	var evicted []Key
+	c, err := New2QCache(4, func(key Key) {
+		evicted = append(evicted, key)
+	})
+	assert.NoError(t, err)
+	cache := c.(*twoQueueCache)
+	keys := make([]Key, 7)
+	for i := range keys {
+		keys[i] = Key{Kind: "itm", Identifier: strconv.Itoa(i)}
+	}
+
+	for _, key := range keys[:5] {
+		cache.Add(key, nil)
+	}
+	assert.Equal(t, []Key{keys[0]}, evicted)
+	assert.True(t, cache.ghosts.Contains(keys[0]))
+
+	// Adding an evicted key again soon after is a ghost hit, which goes straight to the frequent queue.
+	cache.Add(keys[0], nil)
+	assert.True(t, cache.frequent.Contains(keys[0]))
+	assert.False(t, cache.ghosts.Contains(keys[0]))
+
+	// Frequent entries survive a scan, which only churns the recent queue.
+	_, ok := cache.Get(keys[2])
+	assert.True(t, ok)
+	cache.Add(keys[5], nil)
+	cache.Add(keys[6], nil)
+	assert.Equal(t, []Key{keys[0], keys[1], keys[3], keys[4]}, evicted)
+	assert.ElementsMatch(t, []Key{keys[0], keys[2], keys[5], keys[6]}, cache.Keys())
+
+	cache.Remove(keys[5])
+	assert.Len(t, evicted, 4)
+}
+
+func TestARCCache(t *testing.T) {
+	var evicted []Key
+	c, err := NewARCCache(2, func(key Key) {
+		evicted = append(evicted, key)
+	})
+	assert.NoError(t, err)
+	cache := c.(*arcCache)
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+	d := Key{Kind: "itm", Identifier: "d"}
+	e := Key{Kind: "itm", Identifier: "e"}
+
+	cache.Add(a, nil)
+	cache.Add(b, nil)
+	cache.Add(d, nil)
+	assert.Equal(t, []Key{a}, evicted)
+	assert.True(t, cache.b1.Contains(a))
+
+	// A hit in b1 grows the share p of t1.
+	cache.Add(a, nil)
+	assert.Equal(t, 1, cache.p)
+	assert.True(t, cache.t2.Contains(a))
+	assert.Equal(t, []Key{a, b}, evicted)
+
+	// A hit in b2 shrinks it again.
+	_, ok := cache.Get(d)
+	assert.True(t, ok)
+	cache.Add(e, nil)
+	assert.True(t, cache.b2.Contains(a))
+	cache.Add(a, nil)
+	assert.Equal(t, 0, cache.p)
+	assert.True(t, cache.t2.Contains(a))
+	assert.Equal(t, []Key{a, b, a, e}, evicted)
+	assert.ElementsMatch(t, []Key{a, d}, cache.Keys())
+
+	cache.Remove(d)
+	assert.Len(t, evicted, 4)
+}
+
+func TestCache_EvictionCallback(t *testing.T) {
+	for name, factory := range map[string]CacheFactory{"LRU": NewLRUCache, "2Q": New2QCache, "ARC": NewARCCache} {
+		t.Run(name, func(t *testing.T) {
+			live := make(map[Key]bool)
+			cache, err := factory(2, func(key Key) {
+				assert.True(t, live[key], "%v evicted twice or without being cached", key)
+				delete(live, key)
+			})
+			assert.NoError(t, err)
+			add := func(id string) {
+				key := Key{Kind: "itm", Identifier: id}
+				cache.Add(key, nil)
+				live[key] = true
+			}
+
+			// Every entry leaving the cache goes through the callback, so the cache holds exactly the live keys.
+			for _, id := range []string{"a", "b", "c", "a", "b", "d", "e", "a", "e", "f", "b", "c"} {
+				add(id)
+				assert.LessOrEqual(t, cache.Len(), 2)
+				assert.Len(t, cache.Keys(), len(live))
+				for _, key := range cache.Keys() {
+					assert.True(t, live[key])
+				}
+			}
+		})
+	}
+}
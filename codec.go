@@ -0,0 +1,189 @@
+package quickstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// dataField holds the encoded value of items written with a blob codec.
+const dataField = "_data"
+
+// Codec converts values to the attributes of an item and back. The key attributes are added by the store,
+// so a codec must not produce attributes named "_key" or "_sort".
+type Codec interface {
+	Marshal(value interface{}) (map[string]*dynamodb.AttributeValue, error)
+	Unmarshal(avs map[string]*dynamodb.AttributeValue, value interface{}) error
+}
+
+type attributeCodec struct{}
+
+// AttributeCodec maps values with dynamodbattribute, honouring dynamodbav tags and falling back to json tags.
+// It is the default codec.
+var AttributeCodec Codec = attributeCodec{}
+
+func (attributeCodec) Marshal(value interface{}) (map[string]*dynamodb.AttributeValue, error) {
+	return dynamodbattribute.MarshalMap(value)
+}
+
+func (attributeCodec) Unmarshal(avs map[string]*dynamodb.AttributeValue, value interface{}) error {
+	return dynamodbattribute.UnmarshalMap(avs, value)
+}
+
+type jsonCodec struct{}
+
+// JSONCodec maps values with encoding/json, so json tags, their options and custom json.Marshaler
+// implementations apply exactly as they do for JSON. Every JSON field becomes an attribute, numbers are
+// kept without loss of precision.
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) Marshal(value interface{}) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	err = dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("value is encoded as JSON %T, not as an object", doc)
+	}
+	return fromJSON(m).M, nil
+}
+
+func (jsonCodec) Unmarshal(avs map[string]*dynamodb.AttributeValue, value interface{}) error {
+	data, err := json.Marshal(toJSON(&dynamodb.AttributeValue{M: avs}))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func fromJSON(doc interface{}) *dynamodb.AttributeValue {
+	switch v := doc.(type) {
+	case bool:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(v)}
+	case json.Number:
+		return &dynamodb.AttributeValue{N: aws.String(v.String())}
+	case string:
+		return &dynamodb.AttributeValue{S: aws.String(v)}
+	case []interface{}:
+		l := make([]*dynamodb.AttributeValue, len(v))
+		for i, e := range v {
+			l[i] = fromJSON(e)
+		}
+		return &dynamodb.AttributeValue{L: l}
+	case map[string]interface{}:
+		m := make(map[string]*dynamodb.AttributeValue, len(v))
+		for name, e := range v {
+			m[name] = fromJSON(e)
+		}
+		return &dynamodb.AttributeValue{M: m}
+	}
+	return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+}
+
+// toJSON converts attributes to a JSON document. Sets become arrays and binaries base64 strings,
+// as encoding/json expects for []byte.
+func toJSON(av *dynamodb.AttributeValue) interface{} {
+	switch {
+	case av == nil:
+		return nil
+	case av.BOOL != nil:
+		return *av.BOOL
+	case av.N != nil:
+		return json.Number(*av.N)
+	case av.S != nil:
+		return *av.S
+	case av.B != nil:
+		return base64.StdEncoding.EncodeToString(av.B)
+	case av.SS != nil:
+		return aws.StringValueSlice(av.SS)
+	case av.NS != nil:
+		ns := make([]json.Number, len(av.NS))
+		for i, n := range av.NS {
+			ns[i] = json.Number(*n)
+		}
+		return ns
+	case av.BS != nil:
+		bs := make([]string, len(av.BS))
+		for i, b := range av.BS {
+			bs[i] = base64.StdEncoding.EncodeToString(b)
+		}
+		return bs
+	case av.L != nil:
+		l := make([]interface{}, len(av.L))
+		for i, e := range av.L {
+			l[i] = toJSON(e)
+		}
+		return l
+	case av.M != nil:
+		m := make(map[string]interface{}, len(av.M))
+		for name, e := range av.M {
+			m[name] = toJSON(e)
+		}
+		return m
+	}
+	return nil
+}
+
+type blobCodec struct {
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte, interface{}) error
+}
+
+// NewBlobCodec returns a codec storing the whole value as opaque bytes in the attribute "_data", encoded with
+// marshal and decoded with unmarshal, for instance the functions of a msgpack or protobuf package.
+// Attributes of such items cannot be used in queries.
+func NewBlobCodec(marshal func(interface{}) ([]byte, error), unmarshal func([]byte, interface{}) error) Codec {
+	return &blobCodec{marshal: marshal, unmarshal: unmarshal}
+}
+
+// JSONBlobCodec stores values as JSON bytes in a single attribute.
+var JSONBlobCodec = NewBlobCodec(json.Marshal, json.Unmarshal)
+
+func (c *blobCodec) Marshal(value interface{}) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := c.marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*dynamodb.AttributeValue{dataField: {B: data}}, nil
+}
+
+func (c *blobCodec) Unmarshal(avs map[string]*dynamodb.AttributeValue, value interface{}) error {
+	av := avs[dataField]
+	if av == nil {
+		return fmt.Errorf("item has no %s attribute", dataField)
+	}
+	return c.unmarshal(av.B, value)
+}
+
+// codecs selects the codec of each kind.
+type codecs struct {
+	fallback Codec
+	kinds    map[string]Codec
+}
+
+func newCodecs(opts options) codecs {
+	return codecs{
+		fallback: opts.codec,
+		kinds:    opts.kindCodecs,
+	}
+}
+
+func (c codecs) of(kind string) Codec {
+	if codec, ok := c.kinds[kind]; ok {
+		return codec
+	}
+	return c.fallback
+}
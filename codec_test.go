@@ -0,0 +1,52 @@
+package quickstore
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type document struct {
+	Title   string   `json:"title"`
+	Views   int64    `json:"views"`
+	Tags    []string `json:"tags,omitempty"`
+	Draft   bool     `json:"-"`
+	Payload []byte   `json:"payload"`
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	value := document{Title: "Hello", Views: 1<<62 + 1, Tags: []string{"a", "b"}, Payload: []byte{1, 2, 3}}
+	for name, codec := range map[string]Codec{
+		"attribute": AttributeCodec,
+		"json":      JSONCodec,
+		"blob":      JSONBlobCodec,
+	} {
+		avs, err := codec.Marshal(value)
+		assert.NoError(t, err, name)
+		var got document
+		assert.NoError(t, codec.Unmarshal(avs, &got), name)
+		assert.Equal(t, value, got, name)
+	}
+}
+
+func TestCodec_JSON(t *testing.T) {
+	avs, err := JSONCodec.Marshal(document{Title: "Hello", Views: 3, Draft: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", aws.StringValue(avs["title"].S))
+	assert.Equal(t, "3", aws.StringValue(avs["views"].N))
+	assert.Nil(t, avs["tags"])
+	assert.Nil(t, avs["Draft"])
+
+	_, err = JSONCodec.Marshal([]string{"not", "an", "object"})
+	assert.Error(t, err)
+}
+
+func TestCodecs_Of(t *testing.T) {
+	o := defaultOptions()
+	WithCodec(JSONCodec)(&o)
+	WithKindCodec("doc", JSONBlobCodec)(&o)
+	c := newCodecs(o)
+	assert.True(t, c.of("doc") == JSONBlobCodec)
+	assert.True(t, c.of("itm") == JSONCodec)
+}
@@ -0,0 +1,305 @@
+package quickstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// encField describes the encrypted attributes of an item: the names of the attributes, and the data key
+	// encrypting them together with the id of the master key encrypting the data key.
+	encField = "_enc"
+
+	encryptTag = "encrypt"
+	dataKeyLen = 32
+	// dataKeyCacheSize bounds the decrypted data keys kept in memory.
+	dataKeyCacheSize = 4096
+)
+
+// KeyProvider generates and decrypts the data keys used for envelope encryption. Every item gets its own
+// data key, which is stored alongside the item encrypted under a master key of the provider.
+type KeyProvider interface {
+	// GenerateDataKey returns a new data key, both in plaintext and encrypted, with the id of the master key
+	// that encrypted it.
+	GenerateDataKey(ctx context.Context) (keyID string, plaintext []byte, encrypted []byte, err error)
+	DecryptDataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error)
+}
+
+// StaticKeyProvider encrypts data keys with a master key held in memory. It is meant for tests and local
+// development; production keys should live in a key management service.
+type StaticKeyProvider struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewStaticKeyProvider returns a provider with a master key of 16, 24 or 32 bytes.
+func NewStaticKeyProvider(id string, masterKey []byte) (*StaticKeyProvider, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticKeyProvider{id: id, aead: aead}, nil
+}
+
+func (p *StaticKeyProvider) GenerateDataKey(ctx context.Context) (string, []byte, []byte, error) {
+	plaintext := make([]byte, dataKeyLen)
+	_, err := io.ReadFull(rand.Reader, plaintext)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	encrypted, err := seal(p.aead, plaintext, []byte(p.id))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return p.id, plaintext, encrypted, nil
+}
+
+func (p *StaticKeyProvider) DecryptDataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error) {
+	if keyID != p.id {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	return unseal(p.aead, encrypted, []byte(p.id))
+}
+
+// encryptor encrypts the attributes marked with the "encrypt" option of the quickstore struct tag, and the
+// attributes set with WithEncryptedAttributes for the kind of the item.
+//
+// Attributes are compressed as the packer would before they are encrypted, since ciphertexts do not compress.
+// Decrypted data keys are cached by their encrypted form, so that reading an item again, from the cache or
+// from the table, does not call the key provider.
+type encryptor struct {
+	provider KeyProvider
+	kinds    map[string][]string
+	packer   *packer
+	dataKeys *lru.Cache
+}
+
+func newEncryptor(opts options) *encryptor {
+	dataKeys, _ := lru.New(dataKeyCacheSize)
+	return &encryptor{
+		provider: opts.keyProvider,
+		kinds:    opts.encryptedAttributes,
+		packer:   newPacker(opts),
+		dataKeys: dataKeys,
+	}
+}
+
+// dataKeyID identifies a data key by the master key and the ciphertext of the data key.
+type dataKeyID struct {
+	keyID     string
+	encrypted string
+}
+
+// taggedFields caches the names of the attributes tagged for encryption, by struct type.
+var taggedFields sync.Map
+
+func (e *encryptor) attributes(kind string, value interface{}) []string {
+	names := append([]string(nil), e.kinds[kind]...)
+	typ := indirectType(reflect.TypeOf(value))
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return names
+	}
+	tagged, ok := taggedFields.Load(typ)
+	if !ok {
+		tagged, _ = taggedFields.LoadOrStore(typ, fieldsTagged(typ))
+	}
+	return append(names, tagged.([]string)...)
+}
+
+func fieldsTagged(typ reflect.Type) []string {
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		opts := strings.Split(field.Tag.Get("quickstore"), ",")
+		tagged := false
+		for _, opt := range opts {
+			tagged = tagged || opt == encryptTag
+		}
+		if !tagged {
+			continue
+		}
+		// Like dynamodbattribute and encoding/json, name the attribute after the dynamodbav tag, then the json tag.
+		name := strings.Split(field.Tag.Get("dynamodbav"), ",")[0]
+		if name == "" {
+			name = strings.Split(field.Tag.Get("json"), ",")[0]
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// encrypt replaces the attributes to encrypt by their ciphertexts, bound to the key of the item.
+func (e *encryptor) encrypt(ctx context.Context, key Key, value interface{}, avs map[string]*dynamodb.AttributeValue) error {
+	if e.provider == nil {
+		return nil
+	}
+	marked := e.attributes(key.Kind, value)
+	var names []*string
+	for _, name := range marked {
+		if avs[name] != nil {
+			names = append(names, aws.String(name))
+		}
+	}
+	// Blob codecs hold every field in a single attribute, which is encrypted whole when any field is marked.
+	if len(marked) > 0 && avs[dataField] != nil {
+		names = append(names, aws.String(dataField))
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	keyID, plaintext, encrypted, err := e.provider.GenerateDataKey(ctx)
+	if err != nil {
+		return newErrEncryption("cannot generate data key", err)
+	}
+	aead, err := newAEAD(plaintext)
+	if err != nil {
+		return newErrEncryption("invalid data key", err)
+	}
+	var compressed []*string
+	for _, name := range names {
+		data, err := marshalAttribute(avs[*name])
+		if err != nil {
+			return newErrSerializeException(fmt.Sprintf("cannot encode attribute %s", *name), err)
+		}
+		if e.packer.compresses(*name, avs[*name]) {
+			data, err = e.packer.compressor.Compress(data)
+			if err != nil {
+				return newErrSerializeException(fmt.Sprintf("cannot compress attribute %s", *name), err)
+			}
+			compressed = append(compressed, name)
+		}
+		ciphertext, err := seal(aead, data, additionalData(key, *name))
+		if err != nil {
+			return newErrEncryption(fmt.Sprintf("cannot encrypt attribute %s", *name), err)
+		}
+		avs[*name] = &dynamodb.AttributeValue{B: ciphertext}
+	}
+	enc := map[string]*dynamodb.AttributeValue{
+		"attributes": {SS: names},
+		"keyId":      {S: aws.String(keyID)},
+		"dataKey":    {B: encrypted},
+	}
+	if len(compressed) > 0 {
+		enc["compressed"] = &dynamodb.AttributeValue{SS: compressed}
+		enc["codec"] = &dynamodb.AttributeValue{S: aws.String(e.packer.compressor.Name())}
+	}
+	avs[encField] = &dynamodb.AttributeValue{M: enc}
+	return nil
+}
+
+// decrypt returns a copy of the item with its encrypted attributes decrypted.
+func (e *encryptor) decrypt(ctx context.Context, key Key, avs map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	enc := avs[encField]
+	if enc == nil {
+		return avs, nil
+	}
+	if e.provider == nil {
+		return nil, newErrEncryption(fmt.Sprintf("item %s is encrypted but no key provider is set", key.String()), nil)
+	}
+	keyID := aws.StringValue(enc.M["keyId"].S)
+	plaintext, err := e.dataKey(ctx, keyID, enc.M["dataKey"].B)
+	if err != nil {
+		return nil, newErrEncryption(fmt.Sprintf("cannot decrypt data key of item %s", key.String()), err)
+	}
+	aead, err := newAEAD(plaintext)
+	if err != nil {
+		return nil, newErrEncryption("invalid data key", err)
+	}
+	decrypted := make(map[string]*dynamodb.AttributeValue, len(avs))
+	for name, av := range avs {
+		decrypted[name] = av
+	}
+	delete(decrypted, encField)
+	compressed := make(map[string]bool)
+	var codec string
+	if enc.M["compressed"] != nil {
+		for _, name := range aws.StringValueSlice(enc.M["compressed"].SS) {
+			compressed[name] = true
+		}
+		codec = aws.StringValue(enc.M["codec"].S)
+	}
+	for _, name := range aws.StringValueSlice(enc.M["attributes"].SS) {
+		ciphertext := decrypted[name]
+		if ciphertext == nil {
+			continue
+		}
+		data, err := unseal(aead, ciphertext.B, additionalData(key, name))
+		if err != nil {
+			return nil, newErrEncryption(fmt.Sprintf("cannot decrypt attribute %s of item %s", name, key.String()), err)
+		}
+		if compressed[name] {
+			data, err = e.packer.decompress(name, codec, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		value := dynamodb.AttributeValue{}
+		err = json.Unmarshal(data, &value)
+		if err != nil {
+			return nil, newErrSerializeException(fmt.Sprintf("cannot decode attribute %s", name), err)
+		}
+		decrypted[name] = &value
+	}
+	return decrypted, nil
+}
+
+func (e *encryptor) dataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error) {
+	id := dataKeyID{keyID: keyID, encrypted: string(encrypted)}
+	if plaintext, ok := e.dataKeys.Get(id); ok {
+		return plaintext.([]byte), nil
+	}
+	plaintext, err := e.provider.DecryptDataKey(ctx, keyID, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	e.dataKeys.Add(id, plaintext)
+	return plaintext, nil
+}
+
+// additionalData binds a ciphertext to its item and attribute, so it cannot be moved to another one.
+func additionalData(key Key, name string) []byte {
+	return []byte(key.String() + string(segDelim) + name)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with a random nonce, which prefixes the returned ciphertext.
+func seal(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func unseal(aead cipher.AEAD, ciphertext []byte, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], ad)
+}
@@ -0,0 +1,118 @@
+package quickstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+)
+
+type patient struct {
+	Name  string `dynamodbav:"name" quickstore:"encrypt"`
+	Phone string `quickstore:"encrypt"`
+	Email string `dynamodbav:"email"`
+	Ward  string `dynamodbav:"ward"`
+}
+
+func TestEncryptor(t *testing.T) {
+	provider, err := NewStaticKeyProvider("test", make([]byte, 32))
+	assert.NoError(t, err)
+	o := defaultOptions()
+	WithEncryption(provider)(&o)
+	WithEncryptedAttributes("ptn", "email")(&o)
+	e := newEncryptor(o)
+
+	key := Key{Kind: "ptn", Identifier: "1"}
+	value := patient{Name: "Jane", Phone: "555", Email: "jane@example.com", Ward: "B"}
+	avs, err := encodeItem(key, value, o.schema(), AttributeCodec)
+	assert.NoError(t, err)
+	plain, err := dynamodbattribute.MarshalMap(value)
+	assert.NoError(t, err)
+
+	assert.NoError(t, e.encrypt(context.Background(), key, &value, avs))
+	for _, name := range []string{"name", "Phone", "email"} {
+		assert.NotNil(t, avs[name].B, name)
+	}
+	assert.Equal(t, plain["ward"], avs["ward"])
+
+	decrypted, err := e.decrypt(context.Background(), key, avs)
+	assert.NoError(t, err)
+	var got patient
+	assert.NoError(t, dynamodbattribute.UnmarshalMap(decrypted, &got))
+	assert.Equal(t, value, got)
+	assert.Nil(t, decrypted[encField])
+
+	// Ciphertexts are bound to their item.
+	other := Key{Kind: "ptn", Identifier: "2"}
+	_, err = e.decrypt(context.Background(), other, avs)
+	assert.True(t, errors.Is(err, SentinelEncryption))
+}
+
+func TestEncryptor_BlobCodec(t *testing.T) {
+	provider, err := NewStaticKeyProvider("test", make([]byte, 32))
+	assert.NoError(t, err)
+	o := defaultOptions()
+	WithEncryption(provider)(&o)
+	WithKindCodec("ptn", JSONBlobCodec)(&o)
+	n := &node{packer: newPacker(o), encryptor: newEncryptor(o), codecs: newCodecs(o)}
+
+	key := Key{Kind: "ptn", Identifier: "1"}
+	value := patient{Name: "Jane", Phone: "555", Email: "jane@example.com", Ward: "B"}
+	avs, err := n.encodeItem(key, value)
+	assert.NoError(t, err)
+	assert.NotNil(t, avs[encField])
+	assert.False(t, bytes.Contains(avs[dataField].B, []byte("Jane")))
+	assert.False(t, bytes.Contains(avs[dataField].B, []byte("jane@example.com")))
+
+	decrypted, err := n.encryptor.decrypt(context.Background(), key, avs)
+	assert.NoError(t, err)
+	var got patient
+	assert.NoError(t, JSONBlobCodec.Unmarshal(decrypted, &got))
+	assert.Equal(t, value, got)
+}
+
+// countingProvider counts the data keys it decrypts.
+type countingProvider struct {
+	KeyProvider
+	decrypted int
+}
+
+func (p *countingProvider) DecryptDataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error) {
+	p.decrypted++
+	return p.KeyProvider.DecryptDataKey(ctx, keyID, encrypted)
+}
+
+func TestEncryptor_CompressesAndCachesDataKeys(t *testing.T) {
+	static, err := NewStaticKeyProvider("test", make([]byte, 32))
+	assert.NoError(t, err)
+	provider := &countingProvider{KeyProvider: static}
+	o := defaultOptions()
+	WithEncryption(provider)(&o)
+	WithCompression(Gzip, 1024)(&o)
+	e := newEncryptor(o)
+
+	key := Key{Kind: "ptn", Identifier: "1"}
+	value := patient{Name: strings.Repeat("Jane ", 1000), Ward: "B"}
+	avs, err := encodeItem(key, value, o.schema(), AttributeCodec)
+	assert.NoError(t, err)
+	assert.NoError(t, e.encrypt(context.Background(), key, &value, avs))
+	assert.True(t, len(avs["name"].B) < 500)
+
+	// The packer leaves the ciphertext alone.
+	packed, err := newPacker(o).compress(avs)
+	assert.NoError(t, err)
+	assert.Nil(t, packed[codecField])
+
+	for i := 0; i < 3; i++ {
+		decrypted, err := e.decrypt(context.Background(), key, avs)
+		assert.NoError(t, err)
+		var got patient
+		assert.NoError(t, dynamodbattribute.UnmarshalMap(decrypted, &got))
+		assert.Equal(t, value, got)
+	}
+	assert.Equal(t, 1, provider.decrypted)
+}
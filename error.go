@@ -1,18 +1,74 @@
 package quickstore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
 const (
 	ErrCodeSerializeException = "SerializeException"
+	ErrCodeInvalidKey         = "InvalidKey"
+	ErrCodeKindConflict       = "KindConflict"
+	ErrCodeTypeMismatch       = "TypeMismatch"
 	ErrCodeItemExisted        = "ItemExisted"
 	ErrCodeItemNotExisted     = "ItemNotExisted"
 	ErrCodeTooManyRequests    = "TooManyRequests"
+	ErrCodeQueueFull          = "QueueFull"
 	ErrCodeClosed             = "Closed"
+	ErrCodeUnflushed          = "Unflushed"
+	ErrCodeUnsupported        = "Unsupported"
 	ErrCodeDynamoDBException  = "DynamoDBException"
+	ErrCodeThrottled          = "Throttled"
+	ErrCodeConditionFailed    = "ConditionFailed"
+	ErrCodeResourceNotFound   = "ResourceNotFound"
+	ErrCodeValidation         = "Validation"
+	ErrCodeItemTooLarge       = "ItemTooLarge"
+	ErrCodeTimeout            = "Timeout"
+	ErrCodeBlobStore          = "BlobStoreException"
+	ErrCodeEncryption         = "EncryptionException"
+	ErrCodePartialResult      = "PartialResult"
+)
+
+// Sentinel errors match every error with the same code, so that errors.Is(err, SentinelItemNotExisted)
+// holds for any *ErrItemNotExisted in the chain of err.
+var (
+	SentinelSerializeException = sentinel(ErrCodeSerializeException)
+	SentinelInvalidKey         = sentinel(ErrCodeInvalidKey)
+	SentinelKindConflict       = sentinel(ErrCodeKindConflict)
+	SentinelTypeMismatch       = sentinel(ErrCodeTypeMismatch)
+	SentinelItemExisted        = sentinel(ErrCodeItemExisted)
+	SentinelItemNotExisted     = sentinel(ErrCodeItemNotExisted)
+	SentinelTooManyRequests    = sentinel(ErrCodeTooManyRequests)
+	SentinelQueueFull          = sentinel(ErrCodeQueueFull)
+	SentinelClosed             = sentinel(ErrCodeClosed)
+	SentinelUnflushed          = sentinel(ErrCodeUnflushed)
+	SentinelUnsupported        = sentinel(ErrCodeUnsupported)
+	SentinelDynamoDBException  = sentinel(ErrCodeDynamoDBException)
+	SentinelThrottled          = sentinel(ErrCodeThrottled)
+	SentinelConditionFailed    = sentinel(ErrCodeConditionFailed)
+	SentinelResourceNotFound   = sentinel(ErrCodeResourceNotFound)
+	SentinelValidation         = sentinel(ErrCodeValidation)
+	SentinelItemTooLarge       = sentinel(ErrCodeItemTooLarge)
+	SentinelTimeout            = sentinel(ErrCodeTimeout)
+	SentinelBlobStore          = sentinel(ErrCodeBlobStore)
+	SentinelEncryption         = sentinel(ErrCodeEncryption)
+	SentinelPartialResult      = sentinel(ErrCodePartialResult)
 )
 
+func sentinel(code string) Error {
+	return &baseErr{
+		code:    code,
+		message: "sentinel",
+	}
+}
+
 type ErrSerializeException struct {
 	baseErr
 }
@@ -27,6 +83,82 @@ func newErrSerializeException(message string, cause error) *ErrSerializeExceptio
 	}
 }
 
+type ErrInvalidKey struct {
+	baseErr
+	key Key
+}
+
+func newErrInvalidKey(key Key, reason string) *ErrInvalidKey {
+	return &ErrInvalidKey{
+		baseErr: baseErr{
+			code:    ErrCodeInvalidKey,
+			message: fmt.Sprintf("key %+v is invalid: %s", key, reason),
+		},
+		key: key,
+	}
+}
+
+func newErrMalformedKey(s string, reason string) *ErrInvalidKey {
+	return &ErrInvalidKey{
+		baseErr: baseErr{
+			code:    ErrCodeInvalidKey,
+			message: fmt.Sprintf("cannot parse key %q: %s", s, reason),
+		},
+	}
+}
+
+func (e *ErrInvalidKey) Key() Key {
+	return e.key
+}
+
+type ErrKindConflict struct {
+	baseErr
+	kind string
+}
+
+func newErrKindConflict(kind string, reason string) *ErrKindConflict {
+	return &ErrKindConflict{
+		baseErr: baseErr{
+			code:    ErrCodeKindConflict,
+			message: fmt.Sprintf("cannot register kind %q: %s", kind, reason),
+		},
+		kind: kind,
+	}
+}
+
+func (e *ErrKindConflict) Kind() string {
+	return e.kind
+}
+
+type ErrTypeMismatch struct {
+	baseErr
+	kind string
+}
+
+func newErrTypeMismatch(kind string, expected reflect.Type, actual reflect.Type) *ErrTypeMismatch {
+	return &ErrTypeMismatch{
+		baseErr: baseErr{
+			code:    ErrCodeTypeMismatch,
+			message: fmt.Sprintf("kind %q stores values of type %v, got %v", kind, expected, actual),
+		},
+		kind: kind,
+	}
+}
+
+func newErrUntypedKind(kind string) *ErrTypeMismatch {
+	return &ErrTypeMismatch{
+		baseErr: baseErr{
+			code:    ErrCodeTypeMismatch,
+			message: fmt.Sprintf("kind %q has no registered type", kind),
+		},
+		kind: kind,
+	}
+}
+
+func (e *ErrTypeMismatch) Kind() string {
+	return e.kind
+}
+
 type ErrItemExisted struct {
 	baseErr
 	key Key
@@ -61,29 +193,208 @@ func newErrItemNotExisted(key Key) *ErrItemNotExisted {
 	}
 }
 
+func (e *ErrItemNotExisted) Key() Key {
+	return e.key
+}
+
+// RetryableError is implemented by the errors from DynamoDB, telling whether the request may succeed if retried.
+type RetryableError interface {
+	Error
+	Retryable() bool
+}
+
+// newErrFromDynamoDB classifies an error returned by the DynamoDB client.
+func newErrFromDynamoDB(cause error) error {
+	if _, ok := cause.(Error); ok {
+		return cause
+	}
+	if errors.Is(cause, context.DeadlineExceeded) {
+		return newErrTimeout(cause)
+	}
+	aerr, ok := cause.(awserr.Error)
+	if !ok {
+		return newErrDynamoDBException(cause)
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException,
+		dynamodb.ErrCodeRequestLimitExceeded,
+		dynamodb.ErrCodeLimitExceededException,
+		"ThrottlingException":
+		return newErrThrottled(cause)
+	case dynamodb.ErrCodeConditionalCheckFailedException:
+		return newErrConditionFailed(cause)
+	case dynamodb.ErrCodeResourceNotFoundException,
+		dynamodb.ErrCodeTableNotFoundException:
+		return newErrResourceNotFound(cause)
+	case dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
+		return newErrItemTooLarge("item collection size limit exceeded", cause)
+	case "ValidationException", request.InvalidParameterErrCode:
+		if strings.Contains(aerr.Message(), "size has exceeded") {
+			return newErrItemTooLarge("item size has exceeded the maximum allowed size", cause)
+		}
+		return newErrValidation(cause)
+	case request.CanceledErrorCode, request.ErrCodeResponseTimeout, "RequestTimeout", "RequestTimeoutException":
+		return newErrTimeout(cause)
+	}
+	return newErrDynamoDBException(cause)
+}
+
+func isRetryable(err error) bool {
+	var r RetryableError
+	return errors.As(err, &r) && r.Retryable()
+}
+
 type ErrDynamoDBException struct {
 	baseErr
+	retryable bool
 }
 
 func newErrDynamoDBException(cause error) *ErrDynamoDBException {
+	retryable := request.IsErrorRetryable(cause)
+	if aerr, ok := cause.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeInternalServerError {
+		retryable = true
+	}
 	return &ErrDynamoDBException{
 		baseErr: baseErr{
 			code:    ErrCodeDynamoDBException,
 			message: "error from DynamoDB",
 			cause:   cause,
 		},
+		retryable: retryable,
+	}
+}
+
+func (e *ErrDynamoDBException) Retryable() bool {
+	return e.retryable
+}
+
+type ErrThrottled struct {
+	baseErr
+}
+
+func newErrThrottled(cause error) *ErrThrottled {
+	return &ErrThrottled{
+		baseErr: baseErr{
+			code:    ErrCodeThrottled,
+			message: "request throttled by DynamoDB",
+			cause:   cause,
+		},
 	}
 }
 
+func (e *ErrThrottled) Retryable() bool {
+	return true
+}
+
+type ErrConditionFailed struct {
+	baseErr
+}
+
+func newErrConditionFailed(cause error) *ErrConditionFailed {
+	return &ErrConditionFailed{
+		baseErr: baseErr{
+			code:    ErrCodeConditionFailed,
+			message: "conditional check failed",
+			cause:   cause,
+		},
+	}
+}
+
+func (e *ErrConditionFailed) Retryable() bool {
+	return false
+}
+
+type ErrResourceNotFound struct {
+	baseErr
+}
+
+func newErrResourceNotFound(cause error) *ErrResourceNotFound {
+	return &ErrResourceNotFound{
+		baseErr: baseErr{
+			code:    ErrCodeResourceNotFound,
+			message: "table or index not found",
+			cause:   cause,
+		},
+	}
+}
+
+func (e *ErrResourceNotFound) Retryable() bool {
+	return false
+}
+
+type ErrValidation struct {
+	baseErr
+}
+
+func newErrValidation(cause error) *ErrValidation {
+	return &ErrValidation{
+		baseErr: baseErr{
+			code:    ErrCodeValidation,
+			message: "request rejected by DynamoDB validation",
+			cause:   cause,
+		},
+	}
+}
+
+func (e *ErrValidation) Retryable() bool {
+	return false
+}
+
+type ErrItemTooLarge struct {
+	baseErr
+}
+
+func newErrItemTooLarge(message string, cause error) *ErrItemTooLarge {
+	return &ErrItemTooLarge{
+		baseErr: baseErr{
+			code:    ErrCodeItemTooLarge,
+			message: message,
+			cause:   cause,
+		},
+	}
+}
+
+func (e *ErrItemTooLarge) Retryable() bool {
+	return false
+}
+
+// ErrTimeout is returned when a request to DynamoDB times out, and when the context of a read or of a wait
+// for writes is done. Its cause is then the error of the context.
+type ErrTimeout struct {
+	baseErr
+}
+
+func newErrTimeout(cause error) *ErrTimeout {
+	return &ErrTimeout{
+		baseErr: baseErr{
+			code:    ErrCodeTimeout,
+			message: "timed out or was canceled",
+			cause:   cause,
+		},
+	}
+}
+
+func (e *ErrTimeout) Retryable() bool {
+	return true
+}
+
+// ErrTooManyRequests was returned when too many keys of a node were waiting for a read.
+//
+// Deprecated: reads wait for each other without limit and honour their context instead, so it is not returned anymore.
 type ErrTooManyRequests struct {
 	baseErr
 }
 
-func newErrTooManyRequests(message string) *ErrTooManyRequests {
-	return &ErrTooManyRequests{
+type ErrQueueFull struct {
+	baseErr
+}
+
+func newErrQueueFull(message string, cause error) *ErrQueueFull {
+	return &ErrQueueFull{
 		baseErr: baseErr{
-			code:    ErrCodeTooManyRequests,
+			code:    ErrCodeQueueFull,
 			message: message,
+			cause:   cause,
 		},
 	}
 }
@@ -101,6 +412,57 @@ func newErrClosed() *ErrClosed {
 	}
 }
 
+type ErrUnflushed struct {
+	baseErr
+	mutations   []Mutation
+	snapshotErr error
+}
+
+func newErrUnflushed(mutations []Mutation, cause error) *ErrUnflushed {
+	return &ErrUnflushed{
+		baseErr: baseErr{
+			code:    ErrCodeUnflushed,
+			message: fmt.Sprintf("%d mutations could not be flushed", len(mutations)),
+			cause:   cause,
+		},
+		mutations: mutations,
+	}
+}
+
+func (e *ErrUnflushed) Mutations() []Mutation {
+	return e.mutations
+}
+
+// SnapshotErr returns the error saving the cache in Close with WithCacheSnapshot, if any.
+func (e *ErrUnflushed) SnapshotErr() error {
+	return e.snapshotErr
+}
+
+func (e *ErrUnflushed) Error() string {
+	msg := e.baseErr.Error()
+	if e.snapshotErr != nil {
+		msg = fmt.Sprintf("%s\ncannot save cache snapshot: %s", msg, e.snapshotErr.Error())
+	}
+	return msg
+}
+
+func (e *ErrUnflushed) String() string {
+	return e.Error()
+}
+
+type ErrUnsupported struct {
+	baseErr
+}
+
+func newErrUnsupported(message string) *ErrUnsupported {
+	return &ErrUnsupported{
+		baseErr: baseErr{
+			code:    ErrCodeUnsupported,
+			message: message,
+		},
+	}
+}
+
 type Error interface {
 	error
 	Code() string
@@ -137,3 +499,74 @@ func (b baseErr) Message() string {
 func (b baseErr) Cause() error {
 	return b.cause
 }
+
+func (b baseErr) Unwrap() error {
+	return b.cause
+}
+
+// Is reports whether target is an Error with the same code.
+func (b baseErr) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.Code() == b.code
+}
+
+type ErrBlobStore struct {
+	baseErr
+}
+
+func newErrBlobStore(message string, cause error) *ErrBlobStore {
+	return &ErrBlobStore{
+		baseErr: baseErr{
+			code:    ErrCodeBlobStore,
+			message: message,
+			cause:   cause,
+		},
+	}
+}
+
+// Retryable is true, as blob stores fail mostly for transient reasons.
+func (e *ErrBlobStore) Retryable() bool {
+	return true
+}
+
+type ErrEncryption struct {
+	baseErr
+}
+
+func newErrEncryption(message string, cause error) *ErrEncryption {
+	return &ErrEncryption{
+		baseErr: baseErr{
+			code:    ErrCodeEncryption,
+			message: message,
+			cause:   cause,
+		},
+	}
+}
+
+// ErrPartialResult is returned when reading some keys failed, by GetMulti with the items which could be read
+// and by Warm. Its cause is the error of one of the failed keys.
+type ErrPartialResult struct {
+	baseErr
+	failed map[Key]error
+}
+
+func newErrPartialResult(failed map[Key]error) *ErrPartialResult {
+	var cause error
+	for _, err := range failed {
+		cause = err
+		break
+	}
+	return &ErrPartialResult{
+		baseErr: baseErr{
+			code:    ErrCodePartialResult,
+			message: fmt.Sprintf("cannot read %d keys", len(failed)),
+			cause:   cause,
+		},
+		failed: failed,
+	}
+}
+
+// Failed returns the keys which could not be read, with their error.
+func (e *ErrPartialResult) Failed() map[Key]error {
+	return e.failed
+}
@@ -0,0 +1,60 @@
+package quickstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError_Is(t *testing.T) {
+	key := Key{Kind: "itm", Identifier: "1"}
+	err := fmt.Errorf("wrapped: %w", newErrItemNotExisted(key))
+
+	assert.True(t, errors.Is(err, SentinelItemNotExisted))
+	assert.False(t, errors.Is(err, SentinelItemExisted))
+
+	var notExisted *ErrItemNotExisted
+	assert.True(t, errors.As(err, &notExisted))
+	assert.Equal(t, key, notExisted.Key())
+}
+
+func TestError_Unwrap(t *testing.T) {
+	cause := awserr.New("ProvisionedThroughputExceededException", "slow down", nil)
+	err := newErrUnflushed(nil, newErrDynamoDBException(cause))
+
+	assert.True(t, errors.Is(err, SentinelUnflushed))
+	assert.True(t, errors.Is(err, SentinelDynamoDBException))
+	assert.True(t, errors.Is(err, cause))
+
+	var aerr awserr.Error
+	assert.True(t, errors.As(err, &aerr))
+	assert.Equal(t, "ProvisionedThroughputExceededException", aerr.Code())
+}
+
+func TestError_Classify(t *testing.T) {
+	cases := []struct {
+		cause     error
+		sentinel  Error
+		retryable bool
+	}{
+		{awserr.New("ProvisionedThroughputExceededException", "slow down", nil), SentinelThrottled, true},
+		{awserr.New("ConditionalCheckFailedException", "exists", nil), SentinelConditionFailed, false},
+		{awserr.New("ResourceNotFoundException", "no table", nil), SentinelResourceNotFound, false},
+		{awserr.New("ValidationException", "Item size has exceeded the maximum allowed size", nil), SentinelItemTooLarge, false},
+		{awserr.New("ValidationException", "invalid expression", nil), SentinelValidation, false},
+		{awserr.New("RequestCanceled", "canceled", nil), SentinelTimeout, true},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), SentinelTimeout, true},
+		{awserr.New("InternalServerError", "oops", nil), SentinelDynamoDBException, true},
+		{awserr.New("AccessDeniedException", "denied", nil), SentinelDynamoDBException, false},
+	}
+	for _, c := range cases {
+		err := newErrFromDynamoDB(c.cause)
+		assert.True(t, errors.Is(err, c.sentinel), "%v", c.cause)
+		assert.True(t, errors.Is(err, c.cause), "%v", c.cause)
+		assert.Equal(t, c.retryable, isRetryable(err), "%v", c.cause)
+	}
+}
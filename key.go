@@ -3,9 +3,14 @@ package quickstore
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -13,41 +18,173 @@ import (
 
 const (
 	delim = '.'
+
+	keyPrefix   = "~1"
+	segDelim    = '/'
+	kindDelim   = ':'
+	escapeChar  = '%'
+	maxKeyBytes = 2048
 )
 
+type KeyEncoding int
+
+const (
+	// KeyEncodingV1 writes keys as "~1/kind:identifier/kind:identifier", escaping delimiters in kinds and identifiers.
+	KeyEncodingV1 KeyEncoding = iota
+	// KeyEncodingLegacy writes keys as "kindidentifier.kindidentifier", which is how keys were written before
+	// the encoding was versioned.
+	KeyEncodingLegacy
+)
+
+// Key identifies an item. Parent is the encoded key of the parent item, or empty for a root item.
 type Key struct {
 	Parent     string
 	Kind       string
 	Identifier string
 }
 
+type segment struct {
+	kind       string
+	identifier string
+}
+
 func (k *Key) Incomplete() bool {
 	return k.Kind == ""
 }
 
+// String returns the key in the legacy encoding, which is how keys are printed and embedded in items
+// whatever the encoding of the store. Use Encode for the current encoding.
 func (k *Key) String() string {
+	return k.Encode(KeyEncodingLegacy)
+}
+
+func (k *Key) Encode(enc KeyEncoding) string {
 	if k.Incomplete() {
 		return ""
 	}
-	s := k.Kind + k.Identifier
+	if enc == KeyEncodingLegacy {
+		s := k.Kind + k.Identifier
+		parent := k.Parent
+		if segs, err := parseSegments(parent); err == nil {
+			parent = legacySegments(segs)
+		}
+		if parent == "" {
+			return s
+		}
+		return parent + string(delim) + s
+	}
+	s := escape(k.Kind) + string(kindDelim) + escape(k.Identifier)
 	if k.Parent == "" {
-		return s
+		return keyPrefix + string(segDelim) + s
 	}
-	return k.Parent + string(delim) + s
+	return k.Parent + string(segDelim) + s
 }
 
+func (k *Key) Validate() error {
+	if k.Kind == "" {
+		return newErrInvalidKey(*k, "kind is empty")
+	}
+	if k.Identifier == "" {
+		return newErrInvalidKey(*k, "identifier is empty")
+	}
+	if !utf8.ValidString(k.Kind) || !utf8.ValidString(k.Identifier) {
+		return newErrInvalidKey(*k, "kind and identifier must be valid UTF-8")
+	}
+	// Parents in the legacy encoding cannot be checked without the registry. Stores writing the V1 encoding
+	// resolve them with their registry before validating the key.
+	if strings.HasPrefix(k.Parent, keyPrefix) {
+		if _, err := parseSegments(k.Parent); err != nil {
+			return newErrInvalidKey(*k, fmt.Sprintf("parent is not a valid key: %v", err))
+		}
+	} else if !utf8.ValidString(k.Parent) {
+		return newErrInvalidKey(*k, "parent must be valid UTF-8")
+	}
+	// The current encoding is never shorter than the legacy one.
+	if len(k.Encode(KeyEncodingV1)) > maxKeyBytes {
+		return newErrInvalidKey(*k, fmt.Sprintf("encoded key is longer than %d bytes", maxKeyBytes))
+	}
+	return nil
+}
+
+// Parse is like ParseKey, but returns an incomplete key if s is invalid.
 func Parse(s string) Key {
-	front, rear := divideKey(s)
-	for i := 1; i <= len(rear); i++ {
-		if Registry.kinds[rear[:i]] {
-			return Key{
-				Parent: front,
-				Kind: rear[:i],
-				Identifier: rear[i:],
+	return Registry.Parse(s)
+}
+
+func (r *KindRegistry) Parse(s string) Key {
+	key, err := r.ParseKey(s)
+	if err != nil {
+		return Key{}
+	}
+	return key
+}
+
+// ParseKey parses a key with the kinds of the default Registry.
+func ParseKey(s string) (Key, error) {
+	return Registry.ParseKey(s)
+}
+
+// ParseKey parses keys in both the current and the legacy encoding, checking that the kind of every segment
+// is registered. Legacy keys are converted, so the Parent of the returned key is always in the current encoding.
+func (r *KindRegistry) ParseKey(s string) (Key, error) {
+	if s == "" {
+		return Key{}, newErrMalformedKey(s, "key is empty")
+	}
+	if strings.HasPrefix(s, keyPrefix) {
+		segs, err := parseSegments(s)
+		if err != nil {
+			return Key{}, newErrMalformedKey(s, err.Error())
+		}
+		for i, seg := range segs {
+			if !r.has(seg.kind) {
+				return Key{}, newErrMalformedKey(s, fmt.Sprintf("kind %q of segment %d is not registered", seg.kind, i))
 			}
 		}
+		return keyOf(segs), nil
+	}
+	var segs []segment
+	for i, part := range strings.Split(s, string(delim)) {
+		seg, ok := r.parseLegacySegment(part)
+		if !ok {
+			return Key{}, newErrMalformedKey(s, fmt.Sprintf("segment %d %q does not start with a registered kind", i, part))
+		}
+		segs = append(segs, seg)
+	}
+	return keyOf(segs), nil
+}
+
+// ParentKey returns the key of the parent, or an incomplete key if k is a root key.
+func (k *Key) ParentKey() Key {
+	segs, err := parseSegments(k.Parent)
+	if err != nil {
+		return Key{}
+	}
+	return keyOf(segs)
+}
+
+// Ancestors returns the keys of the ancestors, from the root to the parent.
+func (k *Key) Ancestors() []Key {
+	segs, err := parseSegments(k.Parent)
+	if err != nil {
+		return nil
+	}
+	ancestors := make([]Key, len(segs))
+	for i := range segs {
+		ancestors[i] = keyOf(segs[:i+1])
 	}
-	return Key{}
+	return ancestors
+}
+
+func (k *Key) IsAncestorOf(other Key) bool {
+	if k.Incomplete() || other.Parent == "" {
+		return false
+	}
+	if !strings.HasPrefix(other.Parent, keyPrefix) {
+		s := k.String()
+		return other.Parent == s || strings.HasPrefix(other.Parent, s+string(delim))
+	}
+	s := k.Encode(KeyEncodingV1)
+	return other.Parent == s || strings.HasPrefix(other.Parent, s+string(segDelim))
 }
 
 func (k *Key) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
@@ -55,24 +192,136 @@ func (k *Key) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
 	return nil
 }
 
+// UnmarshalDynamoDBAttributeValue decodes keys written by MarshalDynamoDBAttributeValue, which need no registry.
+// Keys written in the legacy encoding are resolved with the kinds of the default Registry.
 func (k *Key) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
 	s := ""
 	if av.S != nil {
 		s = *av.S
 	}
-	kk := Parse(s)
+	if s == "" {
+		*k = Key{}
+		return nil
+	}
+	var kk Key
+	if strings.HasPrefix(s, keyPrefix) {
+		segs, err := parseSegments(s)
+		if err != nil {
+			return newErrMalformedKey(s, err.Error())
+		}
+		kk = keyOf(segs)
+	} else {
+		var err error
+		kk, err = ParseKey(s)
+		if err != nil {
+			return err
+		}
+	}
 	k.Parent = kk.Parent
 	k.Kind = kk.Kind
 	k.Identifier = kk.Identifier
 	return nil
 }
 
-func divideKey(s string) (string, string) {
-	p := strings.LastIndexByte(s, delim)
-	if p == -1 {
-		return "", s
+func keyOf(segs []segment) Key {
+	last := segs[len(segs)-1]
+	key := Key{
+		Kind:       last.kind,
+		Identifier: last.identifier,
+	}
+	for _, seg := range segs[:len(segs)-1] {
+		parent := Key{
+			Parent:     key.Parent,
+			Kind:       seg.kind,
+			Identifier: seg.identifier,
+		}
+		key.Parent = parent.Encode(KeyEncodingV1)
+	}
+	return key
+}
+
+// parseSegments parses a key in the current encoding into its segments, from the root to the key itself.
+func parseSegments(s string) ([]segment, error) {
+	if !strings.HasPrefix(s, keyPrefix+string(segDelim)) {
+		return nil, fmt.Errorf("missing %q prefix", keyPrefix+string(segDelim))
+	}
+	parts := strings.Split(s[len(keyPrefix)+1:], string(segDelim))
+	segs := make([]segment, len(parts))
+	for i, part := range parts {
+		p := strings.IndexByte(part, kindDelim)
+		if p == -1 {
+			return nil, fmt.Errorf("segment %q has no kind delimiter", part)
+		}
+		kind, err := unescape(part[:p])
+		if err != nil {
+			return nil, err
+		}
+		identifier, err := unescape(part[p+1:])
+		if err != nil {
+			return nil, err
+		}
+		if kind == "" || identifier == "" {
+			return nil, fmt.Errorf("segment %q has an empty kind or identifier", part)
+		}
+		segs[i] = segment{kind: kind, identifier: identifier}
+	}
+	return segs, nil
+}
+
+func (r *KindRegistry) parseLegacySegment(s string) (segment, bool) {
+	for i := 1; i <= len(s); i++ {
+		if r.has(s[:i]) {
+			return segment{kind: s[:i], identifier: s[i:]}, true
+		}
+	}
+	return segment{}, false
+}
+
+func legacySegments(segs []segment) string {
+	parts := make([]string, len(segs))
+	for i, seg := range segs {
+		parts[i] = seg.kind + seg.identifier
+	}
+	return strings.Join(parts, string(delim))
+}
+
+func escape(s string) string {
+	if !strings.ContainsAny(s, string([]byte{escapeChar, segDelim, kindDelim})) {
+		return s
+	}
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case escapeChar, segDelim, kindDelim:
+			fmt.Fprintf(&b, "%c%02X", escapeChar, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescape(s string) (string, error) {
+	if strings.IndexByte(s, escapeChar) == -1 {
+		return s, nil
+	}
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != escapeChar {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated escape sequence in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
 	}
-	return s[:p], s[p+1:]
+	return b.String(), nil
 }
 
 func RandIdentifier() string {
@@ -83,3 +332,67 @@ func RandIdentifier() string {
 	}
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// sortableGenerator generates ULID-style identifiers: 48 bits of milliseconds since the Unix epoch followed
+// by 80 random bits. Within a millisecond, the random bits of the previous identifier are incremented,
+// so identifiers from one generator are strictly increasing.
+type sortableGenerator struct {
+	locker sync.Mutex
+	now    func() time.Time
+	ms     uint64
+	hi     uint16
+	lo     uint64
+}
+
+var sortableIdentifiers = sortableGenerator{now: time.Now}
+
+func (g *sortableGenerator) next() string {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	ms := uint64(g.now().UnixNano() / int64(time.Millisecond))
+	if ms > g.ms {
+		var b [10]byte
+		_, err := io.ReadFull(rand.Reader, b[:])
+		if err != nil {
+			panic(fmt.Sprintf("cannot generate unique bytes: %v", err))
+		}
+		g.ms = ms
+		g.hi = binary.BigEndian.Uint16(b[:2])
+		g.lo = binary.BigEndian.Uint64(b[2:])
+	} else {
+		// The clock has not moved forward, so increment the random bits, carrying into the time when they overflow.
+		g.lo++
+		if g.lo == 0 {
+			g.hi++
+			if g.hi == 0 {
+				g.ms++
+			}
+		}
+	}
+	hi := g.ms<<16 | uint64(g.hi)
+	lo := g.lo
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// SortableIdentifier returns a 26 characters identifier which sorts after every identifier previously returned
+// by this process, and roughly by creation time across processes.
+func SortableIdentifier() string {
+	return sortableIdentifiers.next()
+}
+
+// NewSortableKey returns a key with a SortableIdentifier, so children of the same parent sort in creation order.
+func NewSortableKey(parent string, kind string) Key {
+	return Key{
+		Parent:     parent,
+		Kind:       kind,
+		Identifier: SortableIdentifier(),
+	}
+}
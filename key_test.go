@@ -2,6 +2,7 @@ package quickstore
 
 import (
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -9,26 +10,95 @@ import (
 )
 
 func TestParse_Success(t *testing.T) {
-	Registry.Register("prj")
+	r := NewKindRegistry()
+	r.Register("prj")
 	key := Key{
 		Parent:     "",
 		Kind:       "prj",
 		Identifier: RandIdentifier(),
 	}
-	parsed := Parse(key.String())
+	parsed := r.Parse(key.String())
 	assert.Equal(t, key, parsed)
 }
 
 func TestParse_Fail(t *testing.T) {
+	r := NewKindRegistry()
 	key := Key{
 		Parent:     "",
 		Kind:       "prk",
 		Identifier: RandIdentifier(),
 	}
-	parsed := Parse(key.String())
+	parsed := r.Parse(key.String())
 	assert.True(t, parsed.Incomplete())
 }
 
+func TestParse_Escaped(t *testing.T) {
+	r := NewKindRegistry()
+	r.Register("xy")
+	r.Register("zw")
+	parent := Key{
+		Parent:     "",
+		Kind:       "xy",
+		Identifier: "c.d/e",
+	}
+	key := Key{
+		Parent:     parent.Encode(KeyEncodingV1),
+		Kind:       "zw",
+		Identifier: "50%:1",
+	}
+	assert.Equal(t, "~1/xy:c.d%2Fe/zw:50%25%3A1", key.Encode(KeyEncodingV1))
+	assert.Equal(t, key, r.Parse(key.Encode(KeyEncodingV1)))
+}
+
+func TestParse_Legacy(t *testing.T) {
+	r := NewKindRegistry()
+	r.Register("prj")
+	r.Register("abc")
+	key := r.Parse("prj1.abc2")
+	assert.Equal(t, Key{Parent: "~1/prj:1", Kind: "abc", Identifier: "2"}, key)
+	assert.Equal(t, "prj1.abc2", key.Encode(KeyEncodingLegacy))
+}
+
+func TestParseKey_Errors(t *testing.T) {
+	r := NewKindRegistry()
+	r.Register("prj")
+	r.Register("abc")
+	for _, s := range []string{"", "~1/", "~1/prj:1/abc", "~1/prk:1/abc:2", "~1/prj:1/abc:%2", "prj1.prk2"} {
+		_, err := r.ParseKey(s)
+		assert.IsType(t, &ErrInvalidKey{}, err, s)
+	}
+}
+
+func TestAnyKey_Ancestors(t *testing.T) {
+	root := Key{Kind: "prj", Identifier: "1"}
+	child := Key{Parent: root.Encode(KeyEncodingV1), Kind: "abc", Identifier: "2"}
+	grandchild := Key{Parent: child.Encode(KeyEncodingV1), Kind: "abc", Identifier: "3"}
+
+	assert.Equal(t, []Key{root, child}, grandchild.Ancestors())
+	assert.Empty(t, root.Ancestors())
+	assert.Equal(t, child, grandchild.ParentKey())
+	parent := root.ParentKey()
+	assert.True(t, parent.Incomplete())
+
+	assert.True(t, root.IsAncestorOf(grandchild))
+	assert.True(t, child.IsAncestorOf(grandchild))
+	assert.False(t, grandchild.IsAncestorOf(child))
+	other := Key{Kind: "prj", Identifier: "11"}
+	assert.False(t, other.IsAncestorOf(Key{Parent: "~1/prj:1", Kind: "abc", Identifier: "2"}))
+}
+
+func TestParse_DefaultRegistry(t *testing.T) {
+	Registry.Register("dft")
+	key := Key{
+		Parent:     "",
+		Kind:       "dft",
+		Identifier: RandIdentifier(),
+	}
+	assert.Equal(t, key, Parse(key.String()))
+	_, err := ParseKey(key.String())
+	assert.NoError(t, err)
+}
+
 func TestAnyKey_String(t *testing.T) {
 	key := Key{
 		Parent:     "key.parent",
@@ -38,6 +108,24 @@ func TestAnyKey_String(t *testing.T) {
 	assert.Equal(t, "key.parent.apk3dF1k", key.String())
 }
 
+func TestAnyKey_Validate(t *testing.T) {
+	valid := Key{Parent: "~1/prj:1", Kind: "abc", Identifier: "2"}
+	assert.NoError(t, valid.Validate())
+	legacy := Key{Parent: "prj1", Kind: "abc", Identifier: "2"}
+	assert.NoError(t, legacy.Validate())
+
+	invalid := []Key{
+		{Kind: "", Identifier: "1"},
+		{Kind: "abc", Identifier: ""},
+		{Kind: "abc", Identifier: "\xff"},
+		{Parent: "prj\xff", Kind: "abc", Identifier: "2"},
+		{Parent: "~1/prj:%4", Kind: "abc", Identifier: "2"},
+	}
+	for _, key := range invalid {
+		assert.IsType(t, &ErrInvalidKey{}, key.Validate(), key)
+	}
+}
+
 func TestAnyKey_MarshalDynamoDBAttributeValue(t *testing.T) {
 	Registry.Register("abc")
 	key := Key{
@@ -63,4 +151,43 @@ func TestAnyKey_UnmarshalDynamoDBAttributeValue(t *testing.T) {
 		Identifier: "1234",
 	}
 	assert.Equal(t, expected, key)
+
+	// Keys in the current encoding decode without registering their kinds.
+	av = dynamodb.AttributeValue{S: aws.String("~1/unregistered:1/other:2")}
+	assert.NoError(t, key.UnmarshalDynamoDBAttributeValue(&av))
+	assert.Equal(t, Key{Parent: "~1/unregistered:1", Kind: "other", Identifier: "2"}, key)
+}
+
+func TestSortableIdentifier_Monotonic(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	g := sortableGenerator{now: func() time.Time { return now }}
+	prev := g.next()
+	assert.Len(t, prev, 26)
+	for i := 0; i < 1000; i++ {
+		if i%100 == 0 {
+			now = now.Add(time.Millisecond)
+		}
+		id := g.next()
+		assert.True(t, prev < id, "%s < %s", prev, id)
+		prev = id
+	}
+}
+
+func TestSortableIdentifier_Carry(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	g := sortableGenerator{now: func() time.Time { return now }}
+	first := g.next()
+	g.hi = 0xFFFF
+	g.lo = 0xFFFFFFFFFFFFFFFF
+	second := g.next()
+	assert.True(t, first < second)
+	assert.Equal(t, uint64(1600000000001), g.ms)
+}
+
+func TestNewSortableKey(t *testing.T) {
+	parent := Key{Kind: "prj", Identifier: "1"}
+	first := NewSortableKey(parent.String(), "itm")
+	second := NewSortableKey(parent.String(), "itm")
+	assert.NoError(t, first.Validate())
+	assert.True(t, first.String() < second.String())
 }
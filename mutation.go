@@ -0,0 +1,182 @@
+package quickstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type Op string
+
+const (
+	OpInsert Op = "insert"
+	OpUpsert Op = "upsert"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// Mutation is a mutation that has been accepted by the store. For deletions, Item only holds the key attributes.
+type Mutation struct {
+	Seq  Seq
+	Op   Op
+	Key  Key
+	Item map[string]*dynamodb.AttributeValue
+}
+
+var opNames = map[opCode]Op{
+	opInsert: OpInsert,
+	opUpsert: OpUpsert,
+	opUpdate: OpUpdate,
+	opDelete: OpDelete,
+}
+
+var opCodes = map[Op]opCode{
+	OpInsert: opInsert,
+	OpUpsert: opUpsert,
+	OpUpdate: opUpdate,
+	OpDelete: opDelete,
+}
+
+func exportMutations(muts []mutation) []Mutation {
+	exported := make([]Mutation, 0, len(muts))
+	for _, mut := range muts {
+		if mut.op == opNone {
+			continue
+		}
+		exported = append(exported, Mutation{
+			Seq:  mut.seq,
+			Op:   opNames[mut.op],
+			Key:  mut.key,
+			Item: mut.avs,
+		})
+	}
+	return exported
+}
+
+type mutationRecord struct {
+	Seq  Seq             `json:"seq"`
+	Op   Op              `json:"op"`
+	Key  keyRecord       `json:"key"`
+	Item json.RawMessage `json:"item"`
+}
+
+type keyRecord struct {
+	Parent     string `json:"parent,omitempty"`
+	Kind       string `json:"kind"`
+	Identifier string `json:"identifier"`
+}
+
+// ExportMutations writes the mutations to w as JSON Lines, one mutation per line. Items are encoded
+// as map attribute values in the DynamoDB JSON format.
+func ExportMutations(w io.Writer, muts []Mutation) error {
+	enc := json.NewEncoder(w)
+	for _, mut := range muts {
+		item, err := marshalAttribute(&dynamodb.AttributeValue{M: mut.Item})
+		if err != nil {
+			return newErrSerializeException("cannot marshal mutation's item", err)
+		}
+		err = enc.Encode(mutationRecord{
+			Seq: mut.Seq,
+			Op:  mut.Op,
+			Key: keyRecord{
+				Parent:     mut.Key.Parent,
+				Kind:       mut.Key.Kind,
+				Identifier: mut.Key.Identifier,
+			},
+			Item: item,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportMutations reads mutations written by ExportMutations.
+func ImportMutations(r io.Reader) ([]Mutation, error) {
+	var muts []Mutation
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var record mutationRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			return muts, nil
+		}
+		if err != nil {
+			return nil, newErrSerializeException(fmt.Sprintf("cannot decode mutation at line %d", line), err)
+		}
+		if _, ok := opCodes[record.Op]; !ok {
+			return nil, newErrSerializeException(fmt.Sprintf("unknown operation %q at line %d", record.Op, line), nil)
+		}
+		item := dynamodb.AttributeValue{}
+		err = json.Unmarshal(record.Item, &item)
+		if err != nil {
+			return nil, newErrSerializeException(fmt.Sprintf("cannot decode item at line %d", line), err)
+		}
+		muts = append(muts, Mutation{
+			Seq: record.Seq,
+			Op:  record.Op,
+			Key: Key{
+				Parent:     record.Key.Parent,
+				Kind:       record.Key.Kind,
+				Identifier: record.Key.Identifier,
+			},
+			Item: item.M,
+		})
+	}
+}
+
+// marshalAttribute encodes an attribute value in the DynamoDB JSON format, such as {"S":"text"}. Only the set
+// fields are written; json.Unmarshal into a dynamodb.AttributeValue decodes it.
+func marshalAttribute(av *dynamodb.AttributeValue) ([]byte, error) {
+	return json.Marshal(dynamoDBJSON(av))
+}
+
+func dynamoDBJSON(av *dynamodb.AttributeValue) map[string]interface{} {
+	doc := make(map[string]interface{})
+	if av == nil {
+		return doc
+	}
+	if av.B != nil {
+		doc["B"] = av.B
+	}
+	if av.BOOL != nil {
+		doc["BOOL"] = *av.BOOL
+	}
+	if av.BS != nil {
+		doc["BS"] = av.BS
+	}
+	if av.L != nil {
+		l := make([]interface{}, len(av.L))
+		for i, e := range av.L {
+			l[i] = dynamoDBJSON(e)
+		}
+		doc["L"] = l
+	}
+	if av.M != nil {
+		m := make(map[string]interface{}, len(av.M))
+		for name, e := range av.M {
+			m[name] = dynamoDBJSON(e)
+		}
+		doc["M"] = m
+	}
+	if av.N != nil {
+		doc["N"] = *av.N
+	}
+	if av.NS != nil {
+		doc["NS"] = aws.StringValueSlice(av.NS)
+	}
+	if av.NULL != nil {
+		doc["NULL"] = *av.NULL
+	}
+	if av.S != nil {
+		doc["S"] = *av.S
+	}
+	if av.SS != nil {
+		doc["SS"] = aws.StringValueSlice(av.SS)
+	}
+	return doc
+}
@@ -0,0 +1,67 @@
+package quickstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportMutations_RoundTrip(t *testing.T) {
+	muts := []Mutation{
+		{
+			Seq: 1,
+			Op:  OpUpsert,
+			Key: Key{Parent: "prj1", Kind: "itm", Identifier: "2"},
+			Item: map[string]*dynamodb.AttributeValue{
+				"_key": {S: aws.String("prj1.itm2")},
+				"name": {S: aws.String("First Name")},
+				"tags": {L: []*dynamodb.AttributeValue{{N: aws.String("1")}, {BOOL: aws.Bool(true)}}},
+			},
+		},
+		{
+			Seq: 2,
+			Op:  OpDelete,
+			Key: Key{Kind: "itm", Identifier: "3"},
+			Item: map[string]*dynamodb.AttributeValue{
+				"_key": {S: aws.String("itm3")},
+			},
+		},
+	}
+	buf := bytes.Buffer{}
+	err := ExportMutations(&buf, muts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+
+	imported, err := ImportMutations(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, muts, imported)
+}
+
+func TestImportMutations_UnknownOp(t *testing.T) {
+	_, err := ImportMutations(bytes.NewBufferString(`{"seq":1,"op":"merge","key":{"kind":"itm","identifier":"1"},"item":{}}`))
+	assert.IsType(t, &ErrSerializeException{}, err)
+}
+
+func TestMarshalAttribute(t *testing.T) {
+	av := &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		"s":     {S: aws.String("text")},
+		"n":     {N: aws.String("12345678901234567890")},
+		"b":     {B: []byte{1, 2}},
+		"ss":    {SS: aws.StringSlice([]string{"a", "b"})},
+		"null":  {NULL: aws.Bool(true)},
+		"empty": {L: []*dynamodb.AttributeValue{}},
+		"l":     {L: []*dynamodb.AttributeValue{{BOOL: aws.Bool(false)}, {M: map[string]*dynamodb.AttributeValue{}}}},
+	}}
+	data, err := marshalAttribute(av)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"s":{"S":"text"}`)
+	assert.NotContains(t, string(data), "null,")
+
+	got := dynamodb.AttributeValue{}
+	assert.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, av, &got)
+}
@@ -1,150 +1,217 @@
 package quickstore
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/hashicorp/golang-lru/simplelru"
 )
 
 const (
 	cacheCapacity     = 1 << 16
-	maxGet            = 1 << 16
+	maxItemSize       = 400 * 1024
 	getMultiThreshold = 100
 	timeout           = 60 * time.Second
+	minBackoff        = 100 * time.Millisecond
+	maxBackoff        = 10 * time.Second
+	// maxUnflushed bounds the failed mutations a node keeps to report.
+	maxUnflushed = 1 << 16
 )
 
 type node struct {
 	client    *dynamodb.DynamoDB
 	table     string
 	threshold int
+	seq       *uint64
 
-	queue  queue
-	cache  *simplelru.LRU
-	closed bool
+	queue        *queue
+	spill        *spill
+	overflow     OverflowPolicy
+	blockTimeout time.Duration
+	schema       keySchema
+	packer       *packer
+	encryptor    *encryptor
+	codecs       codecs
+	cache        *nodeCache
+	closed       bool
+
+	lastSeq Seq
+	// flushed is the last sequence number flushed. unwritten holds the first sequence number of the mutations
+	// queued or being flushed, and written those of them which were flushed since.
+	flushed        Seq
+	unwritten      seqHeap
+	written        map[Seq]bool
+	flushedCh      chan struct{}
+	flushRequested bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+	// unflushed holds the mutations which were given up, oldest first.
+	unflushed []mutation
+
+	// scans counts the scans of WarmKind in progress, touched holds the keys mutated or flushed since the
+	// first of them started, whose scanned items may be stale.
+	scans   int
+	touched map[Key]bool
 
 	locker    sync.Mutex
-	keyConds  condSet
+	flights   *flightSet
 	flushCond sync.Cond
 
 	done chan struct{}
 }
 
-func newNode(client *dynamodb.DynamoDB, table string, bufSize int, flushThreshold int) (*node, error) {
-	cache, err := simplelru.NewLRU(cacheCapacity, nil)
+func newNode(client *dynamodb.DynamoDB, table string, bufSize int, flushThreshold int, seq *uint64, opts options) (*node, error) {
+	cache, err := newNodeCache(cacheCapacity, opts.cache, opts.cacheOverflow)
 	if err != nil {
 		return nil, err
 	}
 	n := &node{
-		client:    client,
-		table:     table,
-		threshold: flushThreshold,
-		cache:     cache,
-		closed:    false,
-		done:      make(chan struct{}, 1),
+		client:       client,
+		table:        table,
+		threshold:    flushThreshold,
+		seq:          seq,
+		spill:        newSpill(opts.spillDir),
+		overflow:     opts.overflow,
+		blockTimeout: opts.blockTimeout,
+		schema:       opts.schema(),
+		packer:       newPacker(opts),
+		encryptor:    newEncryptor(opts),
+		codecs:       newCodecs(opts),
+		cache:        cache,
+		closed:       false,
+		flushedCh:    make(chan struct{}),
+		written:      make(map[Seq]bool),
+		done:         make(chan struct{}),
 	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
 	n.queue = newQueue(bufSize, &n.locker)
-	n.keyConds = newCondSet(maxGet, &n.locker)
+	n.flights = newFlightSet()
 	n.flushCond.L = &n.locker
 	go n.flush()
 	return n, nil
 }
 
-func (n *node) insert(key Key, value interface{}) error {
-	avs, err := encodeItem(key, value)
+func (n *node) insert(key Key, value interface{}) (Seq, error) {
+	avs, err := n.encodeItem(key, value)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	n.locker.Lock()
 	defer n.locker.Unlock()
 	if n.closed {
-		return newErrClosed()
+		return 0, newErrClosed()
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	cached, err := n.getOrSaveCache(ctx, key)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if cached.state == stateExist {
-		return newErrItemExisted(key)
+		return 0, newErrItemExisted(key)
 	}
-	n.mutate(key, mutation{
+	return n.mutate(key, mutation{
 		op:  opInsert,
 		avs: avs,
 	})
-	return nil
 }
 
-func (n *node) upsert(key Key, value interface{}) error {
-	avs, err := encodeItem(key, value)
+func (n *node) upsert(key Key, value interface{}) (Seq, error) {
+	avs, err := n.encodeItem(key, value)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	n.locker.Lock()
 	defer n.locker.Unlock()
 	if n.closed {
-		return newErrClosed()
+		return 0, newErrClosed()
 	}
-	n.mutate(key, mutation{
+	return n.mutate(key, mutation{
 		op:  opUpsert,
 		avs: avs,
 	})
-	return nil
 }
 
-func (n *node) update(key Key, value interface{}) error {
-	avs, err := encodeItem(key, value)
+func (n *node) update(key Key, value interface{}) (Seq, error) {
+	avs, err := n.encodeItem(key, value)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	n.locker.Lock()
 	defer n.locker.Unlock()
 	if n.closed {
-		return newErrClosed()
+		return 0, newErrClosed()
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	cached, err := n.getOrSaveCache(ctx, key)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if cached.state == stateNotExist {
-		return newErrItemNotExisted(key)
+		return 0, newErrItemNotExisted(key)
 	}
-	n.mutate(key, mutation{
+	return n.mutate(key, mutation{
 		op:  opUpdate,
 		avs: avs,
 	})
-	return nil
 }
 
-func (n *node) delete(key Key) error {
-	avs, err := encodeKey(key)
+func (n *node) delete(key Key) (Seq, error) {
+	avs, err := encodeKey(key, n.schema)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	n.locker.Lock()
 	defer n.locker.Unlock()
 	if n.closed {
-		return newErrClosed()
+		return 0, newErrClosed()
 	}
-	n.mutate(key, mutation{
+	return n.mutate(key, mutation{
 		op:  opDelete,
 		avs: avs,
 	})
-	return nil
 }
 
-func (n *node) mutate(key Key, mut mutation) {
-	n.queue.push(mut)
-	if n.queue.len >= n.threshold {
+// apply enqueues an already encoded mutation.
+func (n *node) apply(key Key, op opCode, avs map[string]*dynamodb.AttributeValue) (Seq, error) {
+	if op != opDelete {
+		err := n.checkSize(key, avs)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	if n.closed {
+		return 0, newErrClosed()
+	}
+	return n.mutate(key, mutation{
+		op:  op,
+		avs: avs,
+	})
+}
+
+func (n *node) mutate(key Key, mut mutation) (Seq, error) {
+	mut.key = key
+	seq, err := n.enqueue(mut)
+	if err != nil {
+		return 0, err
+	}
+	if n.pending() >= n.threshold {
 		n.flushCond.Signal()
 	}
+	n.cache.markDirty(key, seq)
+	n.touch(key)
 	switch mut.op {
 	case opInsert:
 		n.cache.Add(key, cacheValue{
@@ -164,27 +231,133 @@ func (n *node) mutate(key Key, mut mutation) {
 	case opDelete:
 		n.cache.Add(key, cacheValue{state: stateNotExist})
 	}
+	return seq, nil
+}
+
+// enqueue assigns a sequence number to the mutation at the moment it enters the queue,
+// so sequence numbers within a node are always in flush order.
+func (n *node) enqueue(mut mutation) (Seq, error) {
+	if n.spill.empty() && !n.queue.full() {
+		mut.seq = n.nextSeq()
+		n.push(mut)
+		return mut.seq, nil
+	}
+	switch n.overflow {
+	case OverflowFail:
+		return 0, newErrQueueFull("the queue is full", nil)
+	case OverflowSpill:
+		// The sequence number is only recorded as the node's last once the spill accepts the mutation. The
+		// spill writes it to disk in the background, so the node lock is not held meanwhile.
+		mut.seq = Seq(atomic.AddUint64(n.seq, 1))
+		err := n.spill.push(mut)
+		if err != nil {
+			return 0, newErrQueueFull("cannot spill mutation to disk", err)
+		}
+		n.lastSeq = mut.seq
+		return mut.seq, nil
+	}
+	if !n.waitNotFull() {
+		return 0, newErrQueueFull("timed out waiting for the queue", nil)
+	}
+	if n.closed {
+		return 0, newErrClosed()
+	}
+	mut.seq = n.nextSeq()
+	n.push(mut)
+	return mut.seq, nil
+}
+
+// push queues the mutation. Unless it replaces a queued one, its sequence number is tracked as unwritten.
+func (n *node) push(mut mutation) {
+	if first := n.queue.push(mut); first == mut.seq {
+		heap.Push(&n.unwritten, first)
+	}
+}
+
+func (n *node) nextSeq() Seq {
+	n.lastSeq = Seq(atomic.AddUint64(n.seq, 1))
+	return n.lastSeq
+}
+
+// waitNotFull waits for the flusher to make room in the queue. The node lock is released while waiting,
+// so reads on the node are not blocked.
+func (n *node) waitNotFull() bool {
+	if n.blockTimeout <= 0 {
+		for n.queue.full() {
+			n.queue.notFull.Wait()
+		}
+		return true
+	}
+	deadline := time.Now().Add(n.blockTimeout)
+	timer := time.AfterFunc(n.blockTimeout, func() {
+		n.locker.Lock()
+		n.queue.notFull.Broadcast()
+		n.locker.Unlock()
+	})
+	defer timer.Stop()
+	for n.queue.full() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		n.queue.notFull.Wait()
+	}
+	return true
+}
+
+func (n *node) pending() int {
+	return n.queue.len + n.spill.len
 }
 
 func (n *node) get(ctx context.Context, key Key) (*dynamodb.AttributeValue, error) {
-	n.locker.Lock()
-	cached, err := n.getOrSaveCache(ctx, key)
-	n.locker.Unlock()
-	if err != nil {
-		return nil, err
+	cached, ok := n.cached(key)
+	if !ok {
+		var err error
+		n.locker.Lock()
+		cached, err = n.getOrSaveCache(ctx, key)
+		n.locker.Unlock()
+		if err != nil {
+			return nil, err
+		}
 	}
+	return itemOf(key, cached)
+}
+
+// cached returns the cache entry of key if it is not busy, without taking the lock of the node.
+func (n *node) cached(key Key) (cacheValue, bool) {
+	cached, ok := n.cache.load(key)
+	if !ok || cached.state == stateBusy {
+		return cacheValue{}, false
+	}
+	return cached, true
+}
+
+func itemOf(key Key, cached cacheValue) (*dynamodb.AttributeValue, error) {
 	if cached.state == stateNotExist {
 		return nil, newErrItemNotExisted(key)
 	}
 	return &dynamodb.AttributeValue{M: cached.avs}, nil
 }
 
-func (n *node) getMulti(ctx context.Context, keys map[Key]bool) (map[Key]*dynamodb.AttributeValue, error) {
-	n.locker.Lock()
-	multiCached, err := n.getOrSaveCacheMulti(ctx, keys)
-	n.locker.Unlock()
-	if err != nil {
-		return nil, err
+// getMulti returns the items which exist, and the keys which could not be read with their error.
+func (n *node) getMulti(ctx context.Context, keys map[Key]bool, sem chan struct{}) (map[Key]*dynamodb.AttributeValue, map[Key]error) {
+	multiCached := make(map[Key]cacheValue)
+	missing := make(map[Key]bool)
+	for key := range keys {
+		if cached, ok := n.cached(key); ok {
+			multiCached[key] = cached
+		} else {
+			missing[key] = true
+		}
+	}
+	failed := make(map[Key]error)
+	if len(missing) > 0 {
+		var read map[Key]cacheValue
+		n.locker.Lock()
+		read, failed = n.getOrSaveCacheMulti(ctx, missing, sem)
+		n.locker.Unlock()
+		for key, cached := range read {
+			multiCached[key] = cached
+		}
 	}
 	items := make(map[Key]*dynamodb.AttributeValue)
 	for key, cached := range multiCached {
@@ -192,7 +365,118 @@ func (n *node) getMulti(ctx context.Context, keys map[Key]bool) (map[Key]*dynamo
 			items[key] = &dynamodb.AttributeValue{M: cached.avs}
 		}
 	}
-	return items, nil
+	return items, failed
+}
+
+// flushedThrough reports whether every mutation of the node with a sequence number up to seq is flushed.
+// A mutation replacing queued ones is only flushed with them, so it is tracked by its first sequence number.
+// Spilled mutations are only tracked once drained, but they all come after the mutations written so far.
+func (n *node) flushedThrough(seq Seq) bool {
+	for len(n.unwritten) > 0 && n.written[n.unwritten[0]] {
+		delete(n.written, n.unwritten[0])
+		heap.Pop(&n.unwritten)
+	}
+	if len(n.unwritten) > 0 {
+		return seq < n.unwritten[0]
+	}
+	return n.spill.empty() || seq <= n.flushed
+}
+
+func (n *node) requestFlush(seq Seq) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	if n.flushedThrough(seq) {
+		return
+	}
+	n.flushRequested = true
+	n.flushCond.Signal()
+}
+
+// waitFlushed waits until the mutations up to seq are flushed, and reports those which were given up. Every waiter
+// whose range covers a failed mutation reports it, for as long as the node keeps it; see keep.
+func (n *node) waitFlushed(ctx context.Context, seq Seq) error {
+	err := n.waitThrough(ctx, seq)
+	if err != nil && !errors.Is(err, SentinelClosed) {
+		return err
+	}
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	if failed := n.report(seq); len(failed) > 0 {
+		return newErrUnflushed(exportMutations(failed), n.err)
+	}
+	return err
+}
+
+// waitThrough waits until the mutations up to seq are flushed or given up. It returns an ErrClosed if the node
+// stopped before.
+func (n *node) waitThrough(ctx context.Context, seq Seq) error {
+	for {
+		n.locker.Lock()
+		if n.flushedThrough(seq) {
+			n.locker.Unlock()
+			return nil
+		}
+		flushedCh := n.flushedCh
+		n.locker.Unlock()
+		select {
+		case <-flushedCh:
+		case <-n.done:
+			n.locker.Lock()
+			defer n.locker.Unlock()
+			if n.flushedThrough(seq) {
+				return nil
+			}
+			return newErrClosed()
+		case <-ctx.Done():
+			return newErrTimeout(ctx.Err())
+		}
+	}
+}
+
+// report returns the failed mutations up to seq.
+func (n *node) report(seq Seq) []mutation {
+	var failed []mutation
+	for _, mut := range n.unflushed {
+		if mut.first <= seq {
+			failed = append(failed, mut)
+		}
+	}
+	return failed
+}
+
+// keep records mutations which were given up. A failed mutation is kept until a later mutation of its key is
+// written, which makes it moot, or until maxUnflushed later mutations failed, so that memory stays bounded.
+func (n *node) keep(muts ...mutation) {
+	n.unflushed = append(n.unflushed, muts...)
+	if over := len(n.unflushed) - maxUnflushed; over > 0 {
+		n.unflushed = append(n.unflushed[:0], n.unflushed[over:]...)
+	}
+}
+
+// supersede forgets the failed mutations of the key of mut which came before it, once mut is written.
+func (n *node) supersede(mut mutation) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	kept := n.unflushed[:0]
+	for _, failed := range n.unflushed {
+		if failed.key != mut.key || failed.seq >= mut.first {
+			kept = append(kept, failed)
+		}
+	}
+	n.unflushed = kept
+}
+
+func (n *node) markFlushed(mut mutation) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	n.cache.markFlushed(mut.key, mut.seq)
+	n.touch(mut.key)
+	n.written[mut.first] = true
+	if mut.seq > n.flushed {
+		n.flushed = mut.seq
+	}
+	close(n.flushedCh)
+	n.flushedCh = make(chan struct{})
 }
 
 func (n *node) close() {
@@ -205,51 +489,208 @@ func (n *node) close() {
 	n.flushCond.Signal()
 }
 
+// abort makes the flusher give up on the remaining mutations, which are kept in unflushed.
+func (n *node) abort() {
+	n.cancel()
+}
+
 func (n *node) flush() {
-	defer func() {
-		n.done <- struct{}{}
-	}()
+	defer close(n.done)
 	muts := make([]mutation, n.queue.cap)
 	var closed bool
 	var err error
 	for {
 		n.locker.Lock()
-		for !n.closed && n.queue.len < n.threshold {
+		for !n.closed && !n.flushRequested && n.pending() < n.threshold {
 			n.flushCond.Wait()
 		}
-		closed = n.closed
-		muts = muts[:0]
-		for !n.queue.empty() {
-			muts = append(muts, n.queue.pop())
+		n.flushRequested = false
+		muts = n.drain(muts[:0])
+		spilled := !n.spill.empty()
+		n.locker.Unlock()
+		if spilled {
+			muts, err = n.readSpill(muts, n.queue.cap)
+			if err != nil {
+				n.abandon(muts, newErrSerializeException("cannot read spilled mutations", err))
+				return
+			}
 		}
+		n.locker.Lock()
+		closed = n.closed && n.pending() == 0
 		n.locker.Unlock()
-		ok := true
 		for i, mut := range muts {
-			err = n.execute(mut)
+			err := n.executeWithRetry(mut)
 			if err != nil {
-				muts = muts[i:]
-				ok = false
-				break
+				if n.ctx.Err() != nil {
+					n.abandon(muts[i:], n.ctx.Err())
+					return
+				}
+				n.fail(mut, err)
+			} else {
+				n.supersede(mut)
 			}
-		}
-		if !ok {
-			break
+			n.markFlushed(mut)
 		}
 		if closed {
+			n.spill.close()
 			return
 		}
 	}
+}
+
+// executeWithRetry executes the mutation until it succeeds, backing off between attempts. It gives up
+// when the error is not retryable or the node is aborted. Once the item is written, only the deletion of
+// the blob it no longer references is retried.
+func (n *node) executeWithRetry(mut mutation) error {
+	backoff := minBackoff
+	written := false
+	var orphan string
+	for {
+		var err error
+		if !written {
+			orphan, err = n.execute(mut)
+			written = err == nil
+		}
+		if written {
+			err = n.removeBlob(orphan)
+		}
+		if err == nil {
+			return nil
+		}
+		err = newErrFromDynamoDB(err)
+		n.locker.Lock()
+		n.err = err
+		n.locker.Unlock()
+		if !isRetryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-n.ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// fail keeps a mutation rejected by DynamoDB in unflushed, and drops the cached value it left behind
+// unless a later mutation of the same key is pending.
+func (n *node) fail(mut mutation, err error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	n.err = err
+	n.keep(mut)
+	if !n.cache.dirtyAfter(mut.key, mut.seq) {
+		n.cache.Remove(mut.key)
+	}
+}
+
+// evacuate removes the cache entries and the failed mutations of the keys leaving the node, and returns them
+// with the error of the failed mutations. The node must be flushed, so that no pending mutation is left behind.
+func (n *node) evacuate(leaving func(Key) bool) (map[Key]cacheValue, []mutation, error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	entries := make(map[Key]cacheValue)
+	for _, key := range n.cache.Keys() {
+		if !leaving(key) {
+			continue
+		}
+		entry, _ := n.cache.Peek(key)
+		if entry.state != stateBusy {
+			entries[key] = entry
+		}
+		n.cache.Remove(key)
+	}
+	var failed []mutation
+	kept := n.unflushed[:0]
+	for _, mut := range n.unflushed {
+		if leaving(mut.key) {
+			failed = append(failed, mut)
+		} else {
+			kept = append(kept, mut)
+		}
+	}
+	n.unflushed = kept
+	return entries, failed, n.err
+}
+
+// adopt takes over the cache entry of a key moving to the node.
+func (n *node) adopt(key Key, value cacheValue) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	n.cache.Add(key, value)
+}
+
+// adoptFailed takes over a failed mutation of a key moving to the node.
+func (n *node) adoptFailed(mut mutation, cause error) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	n.keep(mut)
+	if n.err == nil {
+		n.err = cause
+	}
+}
+
+// abandon stops the node and keeps every mutation that is not flushed, starting with muts.
+func (n *node) abandon(muts []mutation, cause error) {
 	n.locker.Lock()
+	defer n.locker.Unlock()
 	n.closed = true
-	for n.queue.len > 0 {
-		muts = append(muts, n.queue.pop())
+	if n.err == nil {
+		n.err = cause
 	}
+	n.keep(muts...)
+	for !n.queue.empty() {
+		n.keep(n.queue.pop())
+	}
+	// The node is closed, so nothing is spilled anymore.
+	left := n.spill.len
 	n.locker.Unlock()
-	panic(err)
+	spilled, _ := n.readSpill(nil, left)
+	n.spill.close()
+	n.locker.Lock()
+	n.keep(spilled...)
 }
 
-func (n *node) execute(mut mutation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// drain moves the queued mutations into muts.
+func (n *node) drain(muts []mutation) []mutation {
+	for !n.queue.empty() {
+		muts = append(muts, n.queue.pop())
+	}
+	return muts
+}
+
+// readSpill appends at most max spilled mutations to muts. They come after every queued mutation, and the
+// spill file is read without the node lock, which is only taken to track them as unwritten.
+func (n *node) readSpill(muts []mutation, max int) ([]mutation, error) {
+	var err error
+	for read := 0; read < max; {
+		var spilled []mutation
+		spilled, err = n.spill.read(max - read)
+		n.locker.Lock()
+		n.spill.len -= len(spilled)
+		for _, mut := range spilled {
+			mut.first = mut.seq
+			heap.Push(&n.unwritten, mut.first)
+			muts = append(muts, mut)
+		}
+		empty := n.spill.empty()
+		n.locker.Unlock()
+		read += len(spilled)
+		if err != nil || empty {
+			break
+		}
+	}
+	return muts, err
+}
+
+// execute writes the mutation, and returns the blob of the replaced item if the new item does not reference it.
+// When items are offloaded, writes return the replaced item, which consumes no read capacity.
+func (n *node) execute(mut mutation) (string, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, timeout)
 	defer cancel()
 
 	switch mut.op {
@@ -258,16 +699,47 @@ func (n *node) execute(mut mutation) error {
 	case opUpsert:
 		fallthrough
 	case opUpdate:
-		input := dynamodb.PutItemInput{Item: mut.avs, TableName: &n.table}
-		_, err := n.client.PutItemWithContext(ctx, &input)
-		return err
+		item, err := n.packer.pack(ctx, mut.key, mut.avs)
+		if err != nil {
+			return "", err
+		}
+		input := dynamodb.PutItemInput{
+			Item:      item,
+			TableName: &n.table,
+		}
+		if n.packer.offloads() {
+			input.ReturnValues = aws.String(dynamodb.ReturnValueAllOld)
+		}
+		output, err := n.client.PutItemWithContext(ctx, &input)
+		if err != nil {
+			return "", err
+		}
+		return orphanedBlob(output.Attributes, item), nil
 	case opDelete:
-		input := dynamodb.DeleteItemInput{Key: mut.avs, TableName: &n.table}
-		_, err := n.client.DeleteItemWithContext(ctx, &input)
-		return err
+		input := dynamodb.DeleteItemInput{
+			Key:       mut.avs,
+			TableName: &n.table,
+		}
+		if n.packer.offloads() {
+			input.ReturnValues = aws.String(dynamodb.ReturnValueAllOld)
+		}
+		output, err := n.client.DeleteItemWithContext(ctx, &input)
+		if err != nil {
+			return "", err
+		}
+		return orphanedBlob(output.Attributes, nil), nil
 	}
 
-	return nil
+	return "", nil
+}
+
+func (n *node) removeBlob(name string) error {
+	if name == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, timeout)
+	defer cancel()
+	return n.packer.remove(ctx, name)
 }
 
 type state int
@@ -284,193 +756,616 @@ type cacheValue struct {
 }
 
 func (n *node) getOrSaveCache(ctx context.Context, key Key) (cacheValue, error) {
-	for {
-		untyped, ok := n.cache.Get(key)
-		if !ok {
-			break
-		}
-		cached := untyped.(cacheValue)
-		if cached.state != stateBusy {
-			return cached, nil
-		}
-		ok = n.keyConds.waitAndSignal(key)
-		if !ok {
-			return cacheValue{}, newErrTooManyRequests(fmt.Sprintf("trying to access too many different keys"))
+	for n.flights.busy(key) {
+		err := n.flights.wait(ctx, &n.locker, key)
+		if err != nil {
+			return cacheValue{}, err
 		}
 	}
+	entry, ok := n.cache.Get(key)
+	if ok && entry.state != stateBusy {
+		return entry, nil
+	}
 	value := cacheValue{state: stateBusy}
 	n.cache.Add(key, value)
+	n.flights.start(key)
 	n.locker.Unlock()
 
-	defer n.keyConds.signal(key)
+	defer n.flights.finish(key)
 
-	encoded, err := encodeKey(key)
+	encoded, err := encodeKey(key, n.schema)
 	if err != nil {
 		n.locker.Lock()
-		n.cache.Remove(key)
+		n.dropBusy(key)
 		return cacheValue{}, err
 	}
 	input := dynamodb.GetItemInput{Key: encoded, TableName: &n.table}
 	output, err := n.client.GetItemWithContext(ctx, &input)
 	if err != nil {
 		n.locker.Lock()
-		n.cache.Remove(key)
-		return cacheValue{}, newErrDynamoDBException(err)
+		n.dropBusy(key)
+		return cacheValue{}, newErrFromDynamoDB(err)
 	}
 	if len(output.Item) == 0 {
 		value.state = stateNotExist
 	} else {
 		value.state = stateExist
-		value.avs = output.Item
+		value.avs, err = n.packer.unpack(ctx, output.Item)
+		if err != nil {
+			n.locker.Lock()
+			n.dropBusy(key)
+			return cacheValue{}, err
+		}
 	}
 	n.locker.Lock()
-	untyped, ok := n.cache.Get(key)
-	if !ok || untyped.(cacheValue).state == stateBusy {
+	entry, ok = n.cache.Get(key)
+	if !ok || entry.state == stateBusy {
 		n.cache.Add(key, value)
 		return value, nil
 	}
-	return untyped.(cacheValue), nil
+	return entry, nil
 }
 
-func (n *node) fetchMulti(ctx context.Context, keys map[Key]bool) (map[Key]map[string]*dynamodb.AttributeValue, error) {
+// dropBusy removes the entry of a key whose read failed, unless a mutation replaced it during the read.
+func (n *node) dropBusy(key Key) {
+	entry, ok := n.cache.Peek(key)
+	if ok && entry.state == stateBusy {
+		n.cache.Remove(key)
+	}
+}
+
+// fetchMulti reads the keys in chunks of getMultiThreshold, sent concurrently. Each request holds a slot of sem,
+// which bounds the requests in flight across the nodes. Keys which could not be read are returned in failed.
+func (n *node) fetchMulti(ctx context.Context, keys map[Key]bool, sem chan struct{}) (map[Key]map[string]*dynamodb.AttributeValue, map[Key]error) {
+	items := make(map[Key]map[string]*dynamodb.AttributeValue)
+	failed := make(map[Key]error)
+	var chunks [][]Key
+	var chunk []Key
+	for key := range keys {
+		chunk = append(chunk, key)
+		if len(chunk) == getMultiThreshold {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	var wg sync.WaitGroup
+	var locker sync.Mutex
+	for i, chunk := range chunks {
+		acquired := false
+		select {
+		case sem <- struct{}{}:
+			acquired = true
+		case <-ctx.Done():
+		}
+		if !acquired {
+			locker.Lock()
+			for _, chunk := range chunks[i:] {
+				for _, key := range chunk {
+					failed[key] = newErrTimeout(ctx.Err())
+				}
+			}
+			locker.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func(chunk []Key) {
+			defer wg.Done()
+			output, err := n.fetchChunk(ctx, chunk)
+			<-sem
+			locker.Lock()
+			defer locker.Unlock()
+			for _, key := range chunk {
+				if err != nil {
+					failed[key] = err
+				} else if avs, ok := output[key]; ok {
+					items[key] = avs
+				}
+			}
+		}(chunk)
+	}
+	wg.Wait()
+	return items, failed
+}
+
+// fetchChunk reads at most getMultiThreshold keys with BatchGetItem, until no key is left unprocessed.
+func (n *node) fetchChunk(ctx context.Context, keys []Key) (map[Key]map[string]*dynamodb.AttributeValue, error) {
 	avs := make([]map[string]*dynamodb.AttributeValue, len(keys))
 	items := make(map[Key]map[string]*dynamodb.AttributeValue)
+	encodedKeys := make(map[string]Key)
 	var err error
 
-	i := 0
-	for key := range keys {
-		avs[i], err = encodeKey(key)
+	for i, key := range keys {
+		avs[i], err = encodeKey(key, n.schema)
 		if err != nil {
 			return nil, err
 		}
-		i++
+		encodedKeys[n.schema.id(avs[i])] = key
 	}
 
-	for {
-		ng := len(avs)
-		if ng == 0 {
-			break
-		}
-		if ng > getMultiThreshold {
-			ng = getMultiThreshold
-		}
+	backoff := minBackoff
+	for len(avs) > 0 {
 		tables := make(map[string]*dynamodb.KeysAndAttributes)
-		tables[n.table] = &dynamodb.KeysAndAttributes{Keys: avs[:ng]}
-		avs = avs[ng:]
+		tables[n.table] = &dynamodb.KeysAndAttributes{Keys: avs}
 		input := dynamodb.BatchGetItemInput{RequestItems: tables}
 		output, err := n.client.BatchGetItemWithContext(ctx, &input)
 		if err != nil {
-			return nil, err
+			return nil, newErrFromDynamoDB(err)
 		}
 		if output.Responses != nil {
 			for _, item := range output.Responses[n.table] {
-				key, err := decodeKey(item)
+				key, ok := encodedKeys[n.schema.id(item)]
+				if !ok {
+					continue
+				}
+				items[key], err = n.packer.unpack(ctx, item)
 				if err != nil {
 					return nil, err
 				}
-				items[key] = item
 			}
 		}
+		avs = nil
 		if output.UnprocessedKeys != nil && output.UnprocessedKeys[n.table] != nil {
-			avs = append(avs, output.UnprocessedKeys[n.table].Keys...)
+			avs = output.UnprocessedKeys[n.table].Keys
+		}
+		if len(avs) == 0 {
+			break
+		}
+		// Keys are left unprocessed when the table is throttled, so back off as executeWithRetry does.
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, newErrTimeout(ctx.Err())
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
 		}
 	}
 
 	return items, nil
 }
 
-func (n *node) getOrSaveCacheMulti(ctx context.Context, keys map[Key]bool) (map[Key]cacheValue, error) {
-	items := make(map[Key]cacheValue)
-	notCached := make(map[Key]bool)
+// getTree queries the item of key and its descendants. Cached entries take precedence over the query results,
+// since they may hold mutations that are not flushed yet.
+func (n *node) getTree(ctx context.Context, key Key) (map[Key]*dynamodb.AttributeValue, error) {
+	avs, err := encodeKey(key, n.schema)
+	if err != nil {
+		return nil, err
+	}
+	input := dynamodb.QueryInput{
+		TableName:                &n.table,
+		ConsistentRead:           aws.Bool(true),
+		KeyConditionExpression:   aws.String("#k = :k"),
+		ExpressionAttributeNames: map[string]*string{"#k": aws.String(keyField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":k": avs[keyField],
+		},
+	}
+	if rest := aws.StringValue(avs[sortField].S); rest != rootSort {
+		input.KeyConditionExpression = aws.String("#k = :k AND begins_with(#s, :s)")
+		input.ExpressionAttributeNames["#s"] = aws.String(sortField)
+		input.ExpressionAttributeValues[":s"] = avs[sortField]
+	}
 
-	for key := range keys {
-		untyped, ok := n.cache.Get(key)
-		if !ok {
-			notCached[key] = true
-			continue
+	fetched := make(map[Key]map[string]*dynamodb.AttributeValue)
+	for {
+		output, err := n.client.QueryWithContext(ctx, &input)
+		if err != nil {
+			return nil, newErrFromDynamoDB(err)
 		}
-		cached := untyped.(cacheValue)
-		if cached.state == stateBusy {
-			notCached[key] = true
+		for _, item := range output.Items {
+			itemKey, err := n.schema.decode(item)
+			if err != nil {
+				return nil, err
+			}
+			// begins_with also matches siblings whose identifier extends the one of key.
+			if itemKey == key || key.IsAncestorOf(itemKey) {
+				fetched[itemKey], err = n.packer.unpack(ctx, item)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+
+	items := make(map[Key]*dynamodb.AttributeValue)
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	for itemKey, item := range fetched {
+		entry, ok := n.cache.Get(itemKey)
+		if !ok || entry.state == stateBusy {
+			n.cache.Add(itemKey, cacheValue{
+				state: stateExist,
+				avs:   item,
+			})
+			items[itemKey] = &dynamodb.AttributeValue{M: item}
 			continue
 		}
-		items[key] = cached
+		if entry.state == stateExist {
+			items[itemKey] = &dynamodb.AttributeValue{M: entry.avs}
+		}
 	}
+	return items, nil
+}
 
-	if len(notCached) == 0 {
-		return items, nil
+// warm reads the keys missing from the cache into it.
+func (n *node) warm(ctx context.Context, keys map[Key]bool, sem chan struct{}) map[Key]error {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	// Cached keys are skipped without touching their recency, so that warming does not reorder the cache.
+	missing := make(map[Key]bool)
+	for key := range keys {
+		if _, ok := n.cache.Peek(key); !ok {
+			missing[key] = true
+		}
 	}
+	_, failed := n.getOrSaveCacheMulti(ctx, missing, sem)
+	return failed
+}
 
-	n.locker.Unlock()
-	output, err := n.fetchMulti(ctx, notCached)
+// beginScan starts tracking the keys mutated or flushed while a page of WarmKind is scanned.
+func (n *node) beginScan() {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	if n.scans == 0 {
+		n.touched = make(map[Key]bool)
+	}
+	n.scans++
+}
+
+func (n *node) endScan() {
 	n.locker.Lock()
+	defer n.locker.Unlock()
+	n.scans--
+	if n.scans == 0 {
+		n.touched = nil
+	}
+}
+
+func (n *node) touch(key Key) {
+	if n.scans > 0 {
+		n.touched[key] = true
+	}
+}
+
+// preload caches an item read by a scan, unless the key was mutated or flushed since the scan started. The
+// scanned item may then be older than the table, and the key may have been evicted since.
+func (n *node) preload(ctx context.Context, key Key, item map[string]*dynamodb.AttributeValue) error {
+	avs, err := n.packer.unpack(ctx, item)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	if !n.touched[key] {
+		n.cacheMissing(key, cacheValue{state: stateExist, avs: avs})
+	}
+	return nil
+}
+
+// restore caches an entry read outside of the node, unless the key is cached already or being read,
+// as the node then holds a value at least as recent.
+func (n *node) restore(key Key, value cacheValue) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	n.cacheMissing(key, value)
+}
+
+func (n *node) cacheMissing(key Key, value cacheValue) {
+	if _, ok := n.cache.Peek(key); ok || n.flights.busy(key) {
+		return
+	}
+	n.cache.Add(key, value)
+}
+
+// snapshot returns the cache entries which are neither being read nor holding a pending mutation.
+func (n *node) snapshot() map[Key]cacheValue {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+	entries := make(map[Key]cacheValue)
+	for _, key := range n.cache.Keys() {
+		entry, _ := n.cache.Peek(key)
+		if entry.state != stateBusy && !n.cache.isDirty(key) {
+			entries[key] = entry
+		}
+	}
+	return entries
+}
+
+// getOrSaveCacheMulti marks the keys missing from the cache busy and reads them in one batch, as getOrSaveCache
+// does for a single key, so that every key has at most one read in flight. Keys already busy wait for their read.
+func (n *node) getOrSaveCacheMulti(ctx context.Context, keys map[Key]bool, sem chan struct{}) (map[Key]cacheValue, map[Key]error) {
+	items := make(map[Key]cacheValue)
+	failed := make(map[Key]error)
+	fetching := make(map[Key]bool)
+	var busy []Key
 
 	for key := range keys {
-		untyped, ok := n.cache.Get(key)
-		if !ok || untyped.(cacheValue).state == stateBusy {
-			if notCached[key] {
-				avs, exists := output[key]
-				var cached cacheValue
-				if exists {
+		if n.flights.busy(key) {
+			busy = append(busy, key)
+			continue
+		}
+		entry, ok := n.cache.Get(key)
+		if ok && entry.state != stateBusy {
+			items[key] = entry
+			continue
+		}
+		n.cache.Add(key, cacheValue{state: stateBusy})
+		n.flights.start(key)
+		fetching[key] = true
+	}
+
+	if len(fetching) > 0 {
+		n.locker.Unlock()
+		output, fetchFailed := n.fetchMulti(ctx, fetching, sem)
+		n.locker.Lock()
+
+		for key := range fetching {
+			entry, ok := n.cache.Get(key)
+			if ok && entry.state != stateBusy {
+				// A mutation replaced the entry during the read, it is more recent than what was read.
+				items[key] = entry
+			} else if err, ok := fetchFailed[key]; ok {
+				n.cache.Remove(key)
+				failed[key] = err
+			} else {
+				cached := cacheValue{state: stateNotExist}
+				if avs, exists := output[key]; exists {
 					cached = cacheValue{
 						state: stateExist,
 						avs:   avs,
 					}
-				} else {
-					cached = cacheValue{
-						state: stateNotExist,
-					}
 				}
 				n.cache.Add(key, cached)
 				items[key] = cached
 			}
+			n.flights.finish(key)
+		}
+	}
+
+	for _, key := range busy {
+		cached, err := n.getOrSaveCache(ctx, key)
+		if err != nil {
+			failed[key] = err
 			continue
 		}
-		items[key] = untyped.(cacheValue)
+		items[key] = cached
 	}
 
-	return items, nil
+	return items, failed
 }
 
 const (
-	keyField = "_key"
+	keyField  = "_key"
+	sortField = "_sort"
+	rootSort  = string(segDelim)
 )
 
-func encodeItem(key Key, value interface{}) (map[string]*dynamodb.AttributeValue, error) {
-	avs, err := dynamodbattribute.MarshalMap(value)
+// keySchema describes how keys are stored in the table. With a composite schema, the partition key holds
+// the root ancestor and the sort key holds the rest of the path, or "/" for the root itself. Keys in the
+// legacy encoding are decoded with the kinds of registry, the registry of the store.
+type keySchema struct {
+	encoding  KeyEncoding
+	composite bool
+	registry  *KindRegistry
+}
+
+// writesV1 tells whether keys are written in the V1 encoding, which composite keys always are.
+func (ks keySchema) writesV1() bool {
+	return ks.composite || ks.encoding == KeyEncodingV1
+}
+
+// resolve converts a parent in the legacy encoding to the V1 encoding with the kinds of the registry, when
+// keys are written in the V1 encoding. Written as it is, such a parent would make a key that cannot be
+// decoded.
+func (ks keySchema) resolve(key Key) (Key, error) {
+	if !ks.writesV1() || key.Parent == "" || strings.HasPrefix(key.Parent, keyPrefix) {
+		return key, nil
+	}
+	parent, err := ks.registry.ParseKey(key.Parent)
 	if err != nil {
-		return nil, newErrSerializeException("cannot marshal value", err)
+		return key, newErrInvalidKey(key, fmt.Sprintf("parent is not a valid key: %v", err))
 	}
-	keyAV := &dynamodb.AttributeValue{}
-	err = key.MarshalDynamoDBAttributeValue(keyAV)
+	key.Parent = parent.Encode(KeyEncodingV1)
+	return key, nil
+}
+
+// validate resolves the parent of the key, then validates it.
+func (ks keySchema) validate(key Key) error {
+	key, err := ks.resolve(key)
 	if err != nil {
-		return nil, newErrSerializeException("cannot marshal item's key", err)
+		return err
+	}
+	return key.Validate()
+}
+
+// attributes returns the key attributes of the item. The key must have been validated.
+func (ks keySchema) attributes(key Key) map[string]*dynamodb.AttributeValue {
+	key, _ = ks.resolve(key)
+	avs := make(map[string]*dynamodb.AttributeValue)
+	if !ks.composite {
+		avs[keyField] = &dynamodb.AttributeValue{S: aws.String(key.Encode(ks.encoding))}
+		return avs
+	}
+	root, rest := splitRoot(key)
+	avs[keyField] = &dynamodb.AttributeValue{S: aws.String(root)}
+	avs[sortField] = &dynamodb.AttributeValue{S: aws.String(rest)}
+	return avs
+}
+
+// id returns the encoded key of the item holding avs.
+func (ks keySchema) id(avs map[string]*dynamodb.AttributeValue) string {
+	id := aws.StringValue(avs[keyField].S)
+	if ks.composite {
+		if rest := aws.StringValue(avs[sortField].S); rest != rootSort {
+			id += rest
+		}
+	}
+	return id
+}
+
+func (ks keySchema) decode(avs map[string]*dynamodb.AttributeValue) (Key, error) {
+	if avs[keyField] == nil || (ks.composite && avs[sortField] == nil) {
+		return Key{}, newErrSerializeException("item has no key", nil)
+	}
+	id := ks.id(avs)
+	if !strings.HasPrefix(id, keyPrefix) {
+		key, err := ks.registry.ParseKey(id)
+		if err != nil {
+			return Key{}, newErrSerializeException("cannot decode item's key", err)
+		}
+		return key, nil
+	}
+	segs, err := parseSegments(id)
+	if err != nil {
+		return Key{}, newErrSerializeException("cannot decode item's key", err)
+	}
+	return keyOf(segs), nil
+}
+
+// splitRoot splits the encoded key into the encoded root ancestor and the rest of the path.
+func splitRoot(key Key) (string, string) {
+	s := key.Encode(KeyEncodingV1)
+	start := len(keyPrefix) + 1
+	p := strings.IndexByte(s[start:], segDelim)
+	if p == -1 {
+		return s, rootSort
+	}
+	return s[:start+p], s[start+p:]
+}
+
+// encodeItem encodes and encrypts the item, and rejects it if it is over the item size limit, since DynamoDB
+// would reject it when flushed.
+func (n *node) encodeItem(key Key, value interface{}) (map[string]*dynamodb.AttributeValue, error) {
+	avs, err := encodeItem(key, value, n.schema, n.codecs.of(key.Kind))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = n.encryptor.encrypt(ctx, key, value, avs)
+	if err != nil {
+		return nil, err
+	}
+	err = n.checkSize(key, avs)
+	if err != nil {
+		return nil, err
 	}
-	avs[keyField] = keyAV
 	return avs, nil
 }
 
-func encodeKey(key Key) (map[string]*dynamodb.AttributeValue, error) {
-	av := &dynamodb.AttributeValue{}
-	err := key.MarshalDynamoDBAttributeValue(av)
+// checkSize measures the item once compressed. Items over the limit are accepted if they can be offloaded.
+func (n *node) checkSize(key Key, avs map[string]*dynamodb.AttributeValue) error {
+	max := n.packer.maxItemSize
+	if max <= 0 || n.packer.offloads() {
+		return nil
+	}
+	size, err := n.packer.size(avs)
 	if err != nil {
-		return nil, newErrSerializeException("cannot marshal key", err)
+		return err
+	}
+	if size > max {
+		return newErrItemTooLarge(fmt.Sprintf("item %s is %d bytes, over the limit of %d bytes", key.String(), size, max), nil)
+	}
+	return nil
+}
+
+// itemSize computes the size of an item the way DynamoDB accounts for it: the lengths of the attribute names
+// plus the sizes of the values.
+func itemSize(avs map[string]*dynamodb.AttributeValue) int {
+	size := 0
+	for name, av := range avs {
+		size += len(name) + valueSize(av)
+	}
+	return size
+}
+
+func valueSize(av *dynamodb.AttributeValue) int {
+	switch {
+	case av == nil:
+		return 0
+	case av.S != nil:
+		return len(*av.S)
+	case av.N != nil:
+		return numberSize(*av.N)
+	case av.B != nil:
+		return len(av.B)
+	case av.BOOL != nil, av.NULL != nil:
+		return 1
+	case av.SS != nil:
+		size := 0
+		for _, s := range av.SS {
+			size += len(*s)
+		}
+		return size
+	case av.NS != nil:
+		size := 0
+		for _, s := range av.NS {
+			size += numberSize(*s)
+		}
+		return size
+	case av.BS != nil:
+		size := 0
+		for _, b := range av.BS {
+			size += len(b)
+		}
+		return size
+	case av.L != nil:
+		size := 3
+		for _, v := range av.L {
+			size += 1 + valueSize(v)
+		}
+		return size
+	case av.M != nil:
+		size := 3
+		for name, v := range av.M {
+			size += 1 + len(name) + valueSize(v)
+		}
+		return size
+	}
+	return 0
+}
+
+// numberSize approximates the size of a number, which DynamoDB stores with two significant digits per byte.
+func numberSize(n string) int {
+	digits := 0
+	for i := 0; i < len(n); i++ {
+		if n[i] >= '0' && n[i] <= '9' {
+			digits++
+		}
+	}
+	return (digits+1)/2 + 1
+}
+
+func encodeItem(key Key, value interface{}, ks keySchema, codec Codec) (map[string]*dynamodb.AttributeValue, error) {
+	err := ks.validate(key)
+	if err != nil {
+		return nil, err
+	}
+	avs, err := codec.Marshal(value)
+	if err != nil {
+		return nil, newErrSerializeException("cannot marshal value", err)
+	}
+	for name, av := range ks.attributes(key) {
+		avs[name] = av
 	}
-	avs := make(map[string]*dynamodb.AttributeValue)
-	avs[keyField] = av
 	return avs, nil
 }
 
-func decodeKey(avs map[string]*dynamodb.AttributeValue) (Key, error) {
-	key := Key{}
-	err := key.UnmarshalDynamoDBAttributeValue(avs[keyField])
+func encodeKey(key Key, ks keySchema) (map[string]*dynamodb.AttributeValue, error) {
+	err := ks.validate(key)
 	if err != nil {
-		return Key{}, err
+		return nil, err
 	}
-	return key, nil
+	return ks.attributes(key), nil
 }
 
 type opCode int
@@ -480,27 +1375,41 @@ const (
 	opUpsert
 	opUpdate
 	opDelete
+	opNone
 )
 
 type mutation struct {
 	op  opCode
-	avs map[string]*dynamodb.AttributeValue
+	seq Seq
+	// first is the sequence number of the oldest mutation this one replaced in the queue, or seq.
+	first Seq
+	key   Key
+	avs   map[string]*dynamodb.AttributeValue
 }
 
+// queue is a ring buffer of mutations which keeps at most one pending mutation per key. A mutation on a key
+// that is already queued replaces the queued one and goes to the back, so that writes to different keys keep
+// their order, but it takes over the first sequence number of the replaced one. It leaves an empty slot behind. Empty slots
+// do not count toward the length of the queue, and are skipped by pop. The ring has room for twice the capacity
+// of the queue, and is compacted when empty slots fill it, so compaction is amortized over as many pushes.
 type queue struct {
 	muts []mutation
 	cap  int
+	// len is the number of queued mutations, and used the number of slots between l and r, empty ones included.
 	len  int
+	used int
 	l, r int
+	pos  map[Key]int
 
 	notFull  sync.Cond
 	notEmpty sync.Cond
 }
 
-func newQueue(cap int, locker sync.Locker) queue {
-	q := queue{
-		muts: make([]mutation, cap),
+func newQueue(cap int, locker sync.Locker) *queue {
+	q := &queue{
+		muts: make([]mutation, 2*cap),
 		cap:  cap,
+		pos:  make(map[Key]int),
 	}
 	q.notFull.L = locker
 	q.notEmpty.L = locker
@@ -515,93 +1424,157 @@ func (q *queue) empty() bool {
 	return q.len == 0
 }
 
-func (q *queue) push(mut mutation) {
+// push queues the mutation, and returns its first sequence number.
+func (q *queue) push(mut mutation) Seq {
 	for q.full() {
 		q.notFull.Wait()
 	}
+	if mut.first == 0 {
+		mut.first = mut.seq
+	}
+	if i, ok := q.pos[mut.key]; ok {
+		mut.first = q.muts[i].first
+		mut.op = coalesce(q.muts[i].op, mut.op)
+		q.muts[i] = mutation{}
+		q.len--
+	}
+	if q.used == len(q.muts) {
+		q.compact()
+	}
 	q.muts[q.r] = mut
-	q.r++
-	if q.r == q.cap {
-		q.r = 0
+	if mut.op == opNone {
+		delete(q.pos, mut.key)
+	} else {
+		q.pos[mut.key] = q.r
 	}
+	q.r = q.next(q.r)
+	q.used++
 	q.len++
 	q.notEmpty.Signal()
+	return mut.first
 }
 
 func (q *queue) pop() mutation {
 	for q.empty() {
 		q.notEmpty.Wait()
 	}
+	// Sequence numbers start at 1, so only empty slots have none.
+	for q.muts[q.l].seq == 0 {
+		q.l = q.next(q.l)
+		q.used--
+	}
 	mut := q.muts[q.l]
-	q.l++
-	if q.l == q.cap {
-		q.l = 0
+	q.muts[q.l] = mutation{}
+	if i, ok := q.pos[mut.key]; ok && i == q.l {
+		delete(q.pos, mut.key)
 	}
+	q.l = q.next(q.l)
+	q.used--
 	q.len--
 	q.notFull.Signal()
 	return mut
 }
 
-type condSet struct {
-	locker sync.Locker
-	cap    int
-
-	entries map[Key]condCounter
-	notFull sync.Cond
+func (q *queue) next(i int) int {
+	i++
+	if i == len(q.muts) {
+		i = 0
+	}
+	return i
 }
 
-type condCounter struct {
-	cond *sync.Cond
-	cnt  int
+// compact moves the queued mutations to the front of a new ring, dropping the empty slots.
+func (q *queue) compact() {
+	muts := make([]mutation, len(q.muts))
+	n := 0
+	for ; q.used > 0; q.used-- {
+		mut := q.muts[q.l]
+		q.l = q.next(q.l)
+		if mut.seq == 0 {
+			continue
+		}
+		muts[n] = mut
+		if mut.op != opNone {
+			q.pos[mut.key] = n
+		}
+		n++
+	}
+	q.muts = muts
+	q.l, q.r, q.used = 0, n, n
 }
 
-func (c condCounter) inc() condCounter {
-	c.cnt++
-	return c
+// seqHeap is a min-heap of sequence numbers.
+type seqHeap []Seq
+
+func (h seqHeap) Len() int           { return len(h) }
+func (h seqHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h seqHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *seqHeap) Push(x interface{}) {
+	*h = append(*h, x.(Seq))
 }
 
-func (c condCounter) dec() condCounter {
-	c.cnt--
-	return c
+func (h *seqHeap) Pop() interface{} {
+	old := *h
+	seq := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return seq
 }
 
-func newCondSet(cap int, locker sync.Locker) condSet {
-	c := condSet{
-		entries: make(map[Key]condCounter),
-		locker:  locker,
-		cap:     cap,
+// coalesce combines a queued mutation with a newer one on the same key.
+func coalesce(queued opCode, next opCode) opCode {
+	switch {
+	case queued == opInsert && next == opDelete:
+		// The item did not exist before the insertion, so neither mutation needs to be written.
+		return opNone
+	case queued == opInsert:
+		return opInsert
+	case queued == opDelete && next == opInsert:
+		return opUpsert
+	default:
+		return next
 	}
-	c.notFull.L = locker
-	return c
 }
 
-func (c *condSet) full() bool {
-	return len(c.entries) == c.cap
+// flightSet tracks the reads in flight, at most one per key. Every waiter of a key is released at once when its
+// read completes, so none is starved, and each waits only as long as its context allows. It is guarded by the
+// lock of the node.
+type flightSet struct {
+	flights map[Key]chan struct{}
 }
 
-func (c *condSet) waitAndSignal(key Key) bool {
-	cc, ok := c.entries[key]
-	if !ok {
-		if c.full() {
-			return false
-		}
-		cc = condCounter{cond: &sync.Cond{L: c.locker}}
-	}
-	c.entries[key] = cc.inc()
-	cc.cond.Wait()
-	cc = c.entries[key]
-	if cc.cnt > 1 {
-		c.entries[key] = cc.dec()
-		cc.cond.Signal()
-	} else {
-		delete(c.entries, key)
+func newFlightSet() *flightSet {
+	return &flightSet{flights: make(map[Key]chan struct{})}
+}
+
+func (f *flightSet) busy(key Key) bool {
+	_, ok := f.flights[key]
+	return ok
+}
+
+func (f *flightSet) start(key Key) {
+	f.flights[key] = make(chan struct{})
+}
+
+func (f *flightSet) finish(key Key) {
+	if done, ok := f.flights[key]; ok {
+		close(done)
+		delete(f.flights, key)
 	}
-	return true
 }
 
-func (c *condSet) signal(key Key) {
-	cc, ok := c.entries[key]
-	if ok {
-		cc.cond.Signal()
+// wait releases locker until the read of key completes or ctx is done.
+func (f *flightSet) wait(ctx context.Context, locker sync.Locker, key Key) error {
+	done, ok := f.flights[key]
+	if !ok {
+		return nil
+	}
+	locker.Unlock()
+	defer locker.Lock()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return newErrTimeout(ctx.Err())
 	}
 }
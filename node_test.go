@@ -0,0 +1,235 @@
+package quickstore
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_Coalesce(t *testing.T) {
+	locker := sync.Mutex{}
+	q := newQueue(16, &locker)
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+	c := Key{Kind: "itm", Identifier: "c"}
+
+	q.push(mutation{op: opUpsert, seq: 1, key: a})
+	q.push(mutation{op: opInsert, seq: 2, key: b})
+	q.push(mutation{op: opUpsert, seq: 3, key: a})
+	q.push(mutation{op: opDelete, seq: 4, key: b})
+	q.push(mutation{op: opDelete, seq: 5, key: c})
+	q.push(mutation{op: opInsert, seq: 6, key: c})
+	// The slots left by coalesced mutations are not counted.
+	assert.Equal(t, 3, q.len)
+
+	var muts []mutation
+	for !q.empty() {
+		mut := q.pop()
+		if mut.op != opNone {
+			muts = append(muts, mut)
+		}
+	}
+	assert.Equal(t, []mutation{
+		{op: opUpsert, seq: 3, first: 1, key: a},
+		{op: opUpsert, seq: 6, first: 5, key: c},
+	}, muts)
+	assert.Empty(t, q.pos)
+}
+
+func TestQueue_CoalesceKeepsCapacity(t *testing.T) {
+	locker := sync.Mutex{}
+	q := newQueue(3, &locker)
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+
+	q.push(mutation{op: opUpsert, seq: 1, key: a})
+	for seq := Seq(2); seq < 10; seq++ {
+		q.push(mutation{op: opUpsert, seq: seq, key: b})
+		assert.False(t, q.full())
+		assert.Equal(t, 2, q.len)
+	}
+	assert.Equal(t, mutation{op: opUpsert, seq: 1, first: 1, key: a}, q.pop())
+	assert.Equal(t, mutation{op: opUpsert, seq: 9, first: 2, key: b}, q.pop())
+	assert.True(t, q.empty())
+	assert.Empty(t, q.pos)
+}
+
+func TestNode_CoalescedMutationKeepsFirstSeq(t *testing.T) {
+	cache, err := newNodeCache(16, NewLRUCache, nil)
+	assert.NoError(t, err)
+	n := &node{cache: cache, spill: newSpill(""), seq: new(uint64), flushedCh: make(chan struct{}),
+		written: make(map[Seq]bool), done: make(chan struct{})}
+	n.queue = newQueue(16, &n.locker)
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+
+	n.locker.Lock()
+	for _, key := range []Key{a, b, a} {
+		_, err := n.enqueue(mutation{op: opUpsert, key: key})
+		assert.NoError(t, err)
+	}
+	muts := n.drain(nil)
+	n.locker.Unlock()
+	assert.Equal(t, []mutation{
+		{op: opUpsert, seq: 2, first: 2, key: b},
+		{op: opUpsert, seq: 3, first: 1, key: a},
+	}, muts)
+
+	// Writing b does not flush the first mutation of a, which is written last.
+	n.markFlushed(muts[0])
+	n.locker.Lock()
+	assert.False(t, n.flushedThrough(1))
+	assert.False(t, n.flushedThrough(2))
+	n.locker.Unlock()
+
+	n.fail(muts[1], newErrValidation(nil))
+	n.markFlushed(muts[1])
+	err = n.waitFlushed(context.Background(), 1)
+	var unflushed *ErrUnflushed
+	assert.True(t, errors.As(err, &unflushed))
+	assert.Len(t, unflushed.Mutations(), 1)
+	assert.Equal(t, a, unflushed.Mutations()[0].Key)
+}
+
+func TestKeySchema_Composite(t *testing.T) {
+	ks := keySchema{encoding: KeyEncodingV1, composite: true}
+	root := Key{Kind: "prj", Identifier: "1"}
+	child := Key{Parent: root.Encode(KeyEncodingV1), Kind: "itm", Identifier: "a/b"}
+
+	for key, sort := range map[Key]string{root: "/", child: "/itm:a%2Fb"} {
+		avs := ks.attributes(key)
+		assert.Equal(t, "~1/prj:1", *avs[keyField].S)
+		assert.Equal(t, sort, *avs[sortField].S)
+		assert.Equal(t, key.Encode(KeyEncodingV1), ks.id(avs))
+
+		decoded, err := ks.decode(avs)
+		assert.NoError(t, err)
+		assert.Equal(t, key, decoded)
+	}
+}
+
+func TestKeySchema_LegacyParent(t *testing.T) {
+	r := NewKindRegistry()
+	r.Register("prj")
+	r.Register("abc")
+	key := Key{Parent: "prj1", Kind: "abc", Identifier: "2"}
+
+	for _, ks := range []keySchema{
+		{encoding: KeyEncodingV1, registry: r},
+		{encoding: KeyEncodingV1, composite: true, registry: r},
+	} {
+		avs, err := encodeKey(key, ks)
+		assert.NoError(t, err)
+		decoded, err := ks.decode(avs)
+		assert.NoError(t, err)
+		assert.Equal(t, Key{Parent: "~1/prj:1", Kind: "abc", Identifier: "2"}, decoded)
+
+		_, err = encodeKey(Key{Parent: "unknown1", Kind: "abc", Identifier: "2"}, ks)
+		assert.True(t, errors.Is(err, SentinelInvalidKey))
+	}
+
+	// Legacy parents are written as they are in the legacy encoding.
+	avs, err := encodeKey(key, keySchema{encoding: KeyEncodingLegacy, registry: r})
+	assert.NoError(t, err)
+	assert.Equal(t, "prj1.abc2", *avs[keyField].S)
+}
+
+func TestKeySchema_Registry(t *testing.T) {
+	r := NewKindRegistry()
+	assert.NoError(t, r.Register("scoped"))
+	o := defaultOptions()
+	WithRegistry(r)(&o)
+	ks := o.schema()
+
+	key := Key{Kind: "scoped", Identifier: "1"}
+	decoded, err := ks.decode(ks.attributes(key))
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+
+	// The default registry does not know the kind.
+	fallback := defaultOptions()
+	_, err = fallback.schema().decode(ks.attributes(key))
+	assert.Error(t, err)
+}
+
+func TestNode_ItemSize(t *testing.T) {
+	n := &node{packer: &packer{maxItemSize: 100}, encryptor: &encryptor{}, codecs: codecs{fallback: AttributeCodec}}
+	key := Key{Kind: "itm", Identifier: "1"}
+
+	_, err := n.encodeItem(key, map[string]string{"name": "small"})
+	assert.NoError(t, err)
+
+	_, err = n.encodeItem(key, map[string]string{"name": strings.Repeat("x", 100)})
+	assert.True(t, errors.Is(err, SentinelItemTooLarge))
+
+	n.packer.maxItemSize = 0
+	_, err = n.encodeItem(key, map[string]string{"name": strings.Repeat("x", 100)})
+	assert.NoError(t, err)
+}
+
+func TestItemSize(t *testing.T) {
+	avs := map[string]*dynamodb.AttributeValue{
+		"s": {S: aws.String("abc")},
+		"n": {N: aws.String("12345")},
+		"l": {L: []*dynamodb.AttributeValue{{BOOL: aws.Bool(true)}}},
+		"m": {M: map[string]*dynamodb.AttributeValue{"k": {S: aws.String("v")}}},
+	}
+	assert.Equal(t, 1+3+1+4+1+5+1+6, itemSize(avs))
+}
+
+func TestNode_ReportsFailures(t *testing.T) {
+	cache, err := newNodeCache(16, NewLRUCache, nil)
+	assert.NoError(t, err)
+	n := &node{cache: cache, spill: newSpill(""), flushedCh: make(chan struct{}), written: make(map[Seq]bool),
+		done: make(chan struct{})}
+	ctx := context.Background()
+	a := Key{Kind: "itm", Identifier: "a"}
+	b := Key{Kind: "itm", Identifier: "b"}
+	queue := func(seq Seq, key Key) mutation {
+		n.locker.Lock()
+		defer n.locker.Unlock()
+		n.lastSeq = seq
+		heap.Push(&n.unwritten, seq)
+		return mutation{op: opUpsert, seq: seq, first: seq, key: key}
+	}
+	flush := func(mut mutation, failed bool) {
+		if failed {
+			n.fail(mut, newErrValidation(nil))
+		} else {
+			n.supersede(mut)
+		}
+		n.markFlushed(mut)
+	}
+
+	flush(queue(1, a), true)
+	assert.True(t, errors.Is(n.waitFlushed(ctx, 1), SentinelUnflushed))
+	// A failure seen by a waiter, such as a background Flush, is still reported to later ones.
+	assert.True(t, errors.Is(n.waitFlushed(ctx, 1), SentinelUnflushed))
+	// A successful write of the same key makes the failure moot.
+	flush(queue(2, a), false)
+	assert.NoError(t, n.waitFlushed(ctx, 2))
+	assert.Empty(t, n.unflushed)
+
+	// Every waiter whose range covers a failure reports it, whenever it arrives.
+	third := queue(3, b)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- n.waitFlushed(ctx, 3)
+		}()
+	}
+	flush(third, true)
+	for i := 0; i < 2; i++ {
+		assert.True(t, errors.Is(<-errs, SentinelUnflushed))
+	}
+	assert.True(t, errors.Is(n.waitFlushed(ctx, 3), SentinelUnflushed))
+	assert.NoError(t, n.waitFlushed(ctx, 2))
+	assert.Len(t, n.unflushed, 1)
+}
@@ -0,0 +1,225 @@
+package quickstore
+
+import (
+	"os"
+	"time"
+)
+
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota
+	OverflowFail
+	OverflowSpill
+)
+
+type options struct {
+	overflow     OverflowPolicy
+	blockTimeout time.Duration
+	spillDir     string
+	keyEncoding  KeyEncoding
+	compositeKey bool
+	registry     *KindRegistry
+	maxItemSize  int
+
+	compressor         Compressor
+	compressThreshold  int
+	compressAttributes []string
+	blobs              BlobStore
+
+	keyProvider         KeyProvider
+	encryptedAttributes map[string][]string
+
+	codec      Codec
+	kindCodecs map[string]Codec
+
+	numNodes       int
+	getConcurrency int
+
+	cache         CacheFactory
+	cacheOverflow func(pinned int)
+	warmRate      int
+	snapshotPath  string
+}
+
+func defaultOptions() options {
+	return options{
+		overflow:       OverflowBlock,
+		blockTimeout:   0,
+		spillDir:       os.TempDir(),
+		keyEncoding:    KeyEncodingLegacy,
+		registry:       Registry,
+		maxItemSize:    maxItemSize,
+		codec:          AttributeCodec,
+		numNodes:       defaultNumNodes,
+		getConcurrency: 8,
+		cache:          NewLRUCache,
+		warmRate:       defaultWarmRate,
+	}
+}
+
+type Option func(*options)
+
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(o *options) {
+		o.overflow = policy
+	}
+}
+
+// WithBlockTimeout bounds the time a mutation waits for a full queue under OverflowBlock,
+// zero means waiting indefinitely.
+func WithBlockTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.blockTimeout = d
+	}
+}
+
+func WithSpillDir(dir string) Option {
+	return func(o *options) {
+		o.spillDir = dir
+	}
+}
+
+// WithKeyEncoding sets the encoding of the key attribute. The default is KeyEncodingLegacy, which existing
+// tables are written with. New tables should use KeyEncodingV1, which is unambiguous and required by
+// composite keys and WarmKind; a table cannot mix both encodings.
+func WithKeyEncoding(enc KeyEncoding) Option {
+	return func(o *options) {
+		o.keyEncoding = enc
+	}
+}
+
+// WithRegistry sets the registry checking the values stored under each kind, and resolving the kinds of the
+// legacy keys the store reads. The default is Registry.
+func WithRegistry(r *KindRegistry) Option {
+	return func(o *options) {
+		o.registry = r
+	}
+}
+
+// WithCompositeKey stores items in a table whose partition key "_key" holds the root ancestor and whose
+// sort key "_sort" holds the rest of the path, so that Store.GetTree reads a whole tree with one query.
+// It requires KeyEncodingV1.
+func WithCompositeKey() Option {
+	return func(o *options) {
+		o.compositeKey = true
+	}
+}
+
+// WithMaxItemSize sets the largest encoded item, in bytes, that Insert, Upsert and Update accept.
+// The default is the 400 KB limit of DynamoDB, zero disables the check.
+func WithMaxItemSize(size int) Option {
+	return func(o *options) {
+		o.maxItemSize = size
+	}
+}
+
+// WithCompression compresses the attributes whose encoded size is at least threshold bytes. When attributes
+// are given, only those are compressed. Compressed attributes are restored transparently when read.
+func WithCompression(c Compressor, threshold int, attributes ...string) Option {
+	return func(o *options) {
+		o.compressor = c
+		o.compressThreshold = threshold
+		o.compressAttributes = attributes
+	}
+}
+
+// WithBlobStore offloads the attributes of items over the item size limit to b, instead of rejecting them.
+// Only the key of such items is kept in the table, and reads fetch the rest from b.
+func WithBlobStore(b BlobStore) Option {
+	return func(o *options) {
+		o.blobs = b
+	}
+}
+
+// WithEncryption encrypts the attributes marked for encryption with data keys from p, before they reach the cache
+// or DynamoDB. Attributes are marked with the "encrypt" option of the quickstore struct tag, as in
+// `quickstore:"encrypt"`, or with WithEncryptedAttributes.
+func WithEncryption(p KeyProvider) Option {
+	return func(o *options) {
+		o.keyProvider = p
+	}
+}
+
+// WithEncryptedAttributes marks attributes of the items of kind for encryption. It requires WithEncryption.
+func WithEncryptedAttributes(kind string, names ...string) Option {
+	return func(o *options) {
+		if o.encryptedAttributes == nil {
+			o.encryptedAttributes = make(map[string][]string)
+		}
+		o.encryptedAttributes[kind] = append(o.encryptedAttributes[kind], names...)
+	}
+}
+
+// WithCodec sets the codec of the kinds without one set by WithKindCodec. The default is AttributeCodec.
+func WithCodec(c Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+func WithKindCodec(kind string, c Codec) Option {
+	return func(o *options) {
+		if o.kindCodecs == nil {
+			o.kindCodecs = make(map[string]Codec)
+		}
+		o.kindCodecs[kind] = c
+	}
+}
+
+// WithNodes sets the number of nodes, each with its own queue, cache and flusher. The default is 16.
+// Store.Resize changes it on a live store.
+func WithNodes(n int) Option {
+	return func(o *options) {
+		o.numNodes = n
+	}
+}
+
+// WithGetConcurrency bounds the requests a single GetMulti sends to DynamoDB at once. The default is 8.
+func WithGetConcurrency(n int) Option {
+	return func(o *options) {
+		o.getConcurrency = n
+	}
+}
+
+// WithCache sets the cache of the nodes, and with it the eviction policy. NewLRUCache is the default,
+// New2QCache and NewARCCache keep the frequently read entries when many cold keys are read once.
+func WithCache(f CacheFactory) Option {
+	return func(o *options) {
+		o.cache = f
+	}
+}
+
+// WithCacheOverflow sets a function called when the cache of a node holds more entries than its capacity.
+// Entries whose mutation is not flushed yet are never evicted, so the cache grows past its capacity when
+// the flusher falls behind. f is called with the number of such entries each time one more is kept, under
+// the lock of the node: it must be fast and must not use the store.
+func WithCacheOverflow(f func(pinned int)) Option {
+	return func(o *options) {
+		o.cacheOverflow = f
+	}
+}
+
+// WithWarmRate bounds the requests Warm and WarmKind send to DynamoDB to rate per second. The default is 25,
+// zero removes the bound.
+func WithWarmRate(rate int) Option {
+	return func(o *options) {
+		o.warmRate = rate
+	}
+}
+
+// WithCacheSnapshot restores the cache from the file at path in NewStore, and saves the cache to it in Close.
+// A missing or corrupt file is ignored. See Store.LoadCache for when restored entries can be stale.
+func WithCacheSnapshot(path string) Option {
+	return func(o *options) {
+		o.snapshotPath = path
+	}
+}
+
+func (o *options) schema() keySchema {
+	return keySchema{
+		encoding:  o.keyEncoding,
+		composite: o.compositeKey,
+		registry:  o.registry,
+	}
+}
@@ -0,0 +1,282 @@
+package quickstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// codecField maps the name of every compressed attribute to the name of its compressor.
+	codecField = "_codec"
+	// blobField holds the name of the blob holding the attributes of an offloaded item.
+	blobField = "_blob"
+	// blobDelim separates the key from the random suffix in blob names.
+	blobDelim = "#"
+)
+
+// Compressor compresses attribute values. Gzip is provided, other algorithms such as zstd can be plugged in
+// by implementing it.
+type Compressor interface {
+	// Name identifies the algorithm in stored items, so it must not change once items are written.
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+type gzipCompressor struct{}
+
+// Gzip compresses with compress/gzip at the default level.
+var Gzip Compressor = gzipCompressor{}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// BlobStore holds the attributes of items which are too large for the table even after compression.
+// Blobs are named after the encoded key of their item, so writing an item again overwrites its blob.
+type BlobStore interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	// Delete removes a blob. Deleting a blob that does not exist must succeed.
+	Delete(ctx context.Context, name string) error
+}
+
+// packer turns items into what is written to the table and back. Attributes over the threshold are compressed,
+// and items still over the size limit are offloaded to the blob store, leaving only their key in the table.
+// Items are kept unpacked in the queue and in the cache.
+type packer struct {
+	schema      keySchema
+	compressor  Compressor
+	threshold   int
+	attributes  map[string]bool
+	blobs       BlobStore
+	maxItemSize int
+}
+
+func newPacker(opts options) *packer {
+	p := &packer{
+		schema:      opts.schema(),
+		compressor:  opts.compressor,
+		threshold:   opts.compressThreshold,
+		blobs:       opts.blobs,
+		maxItemSize: opts.maxItemSize,
+	}
+	if len(opts.compressAttributes) > 0 {
+		p.attributes = make(map[string]bool)
+		for _, name := range opts.compressAttributes {
+			p.attributes[name] = true
+		}
+	}
+	return p
+}
+
+// size returns the size of the item once packed, not counting offloading.
+func (p *packer) size(avs map[string]*dynamodb.AttributeValue) (int, error) {
+	size := itemSize(avs)
+	if p.compressor == nil || size <= p.maxItemSize {
+		return size, nil
+	}
+	compressed, err := p.compress(avs)
+	if err != nil {
+		return 0, err
+	}
+	return itemSize(compressed), nil
+}
+
+// offloads tells whether items over the size limit are offloaded rather than rejected.
+func (p *packer) offloads() bool {
+	return p.blobs != nil
+}
+
+func (p *packer) pack(ctx context.Context, key Key, avs map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	packed, err := p.compress(avs)
+	if err != nil {
+		return nil, err
+	}
+	if p.blobs == nil || p.maxItemSize <= 0 || itemSize(packed) <= p.maxItemSize {
+		return packed, nil
+	}
+	item := p.schema.attributes(key)
+	rest := make(map[string]*dynamodb.AttributeValue)
+	for name, av := range packed {
+		if _, ok := item[name]; !ok {
+			rest[name] = av
+		}
+	}
+	data, err := marshalAttribute(&dynamodb.AttributeValue{M: rest})
+	if err != nil {
+		return nil, newErrSerializeException("cannot encode offloaded item", err)
+	}
+	// Each version gets its own blob, so the blob of the current item is never overwritten before the new item
+	// is written. A write that fails leaves its blob unreferenced.
+	name := key.String() + blobDelim + RandIdentifier()
+	err = p.blobs.Put(ctx, name, data)
+	if err != nil {
+		return nil, newErrBlobStore(fmt.Sprintf("cannot put blob %s", name), err)
+	}
+	item[blobField] = &dynamodb.AttributeValue{S: aws.String(name)}
+	return item, nil
+}
+
+// compresses tells whether the attribute is compressed when packed.
+func (p *packer) compresses(name string, av *dynamodb.AttributeValue) bool {
+	if p.compressor == nil || name == keyField || name == sortField || name == encField {
+		return false
+	}
+	if p.attributes != nil && !p.attributes[name] {
+		return false
+	}
+	return valueSize(av) >= p.threshold
+}
+
+// compress compresses the attributes over the threshold. Encrypted attributes are skipped, as the encryptor
+// already compressed them before encrypting them.
+func (p *packer) compress(avs map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	if p.compressor == nil {
+		return avs, nil
+	}
+	encrypted := make(map[string]bool)
+	if enc := avs[encField]; enc != nil && enc.M["attributes"] != nil {
+		for _, name := range aws.StringValueSlice(enc.M["attributes"].SS) {
+			encrypted[name] = true
+		}
+	}
+	packed := make(map[string]*dynamodb.AttributeValue, len(avs))
+	codecs := make(map[string]*dynamodb.AttributeValue)
+	for name, av := range avs {
+		packed[name] = av
+		if encrypted[name] || !p.compresses(name, av) {
+			continue
+		}
+		data, err := marshalAttribute(av)
+		if err != nil {
+			return nil, newErrSerializeException(fmt.Sprintf("cannot encode attribute %s", name), err)
+		}
+		compressed, err := p.compressor.Compress(data)
+		if err != nil {
+			return nil, newErrSerializeException(fmt.Sprintf("cannot compress attribute %s", name), err)
+		}
+		packed[name] = &dynamodb.AttributeValue{B: compressed}
+		codecs[name] = &dynamodb.AttributeValue{S: aws.String(p.compressor.Name())}
+	}
+	if len(codecs) > 0 {
+		packed[codecField] = &dynamodb.AttributeValue{M: codecs}
+	}
+	return packed, nil
+}
+
+// unpack restores an item read from the table. Items written without compression or offloading are returned as is.
+func (p *packer) unpack(ctx context.Context, avs map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	if avs[blobField] == nil && avs[codecField] == nil {
+		return avs, nil
+	}
+	unpacked := make(map[string]*dynamodb.AttributeValue, len(avs))
+	for name, av := range avs {
+		unpacked[name] = av
+	}
+	if av := unpacked[blobField]; av != nil {
+		delete(unpacked, blobField)
+		name := aws.StringValue(av.S)
+		if p.blobs == nil {
+			return nil, newErrUnsupported(fmt.Sprintf("item is offloaded to blob %s but no blob store is set", name))
+		}
+		data, err := p.blobs.Get(ctx, name)
+		if err != nil {
+			return nil, newErrBlobStore(fmt.Sprintf("cannot get blob %s", name), err)
+		}
+		rest := dynamodb.AttributeValue{}
+		err = json.Unmarshal(data, &rest)
+		if err != nil {
+			return nil, newErrSerializeException(fmt.Sprintf("cannot decode blob %s", name), err)
+		}
+		for name, av := range rest.M {
+			unpacked[name] = av
+		}
+	}
+	if av := unpacked[codecField]; av != nil {
+		delete(unpacked, codecField)
+		for name, codec := range av.M {
+			compressed := unpacked[name]
+			if compressed == nil {
+				continue
+			}
+			data, err := p.decompress(name, aws.StringValue(codec.S), compressed.B)
+			if err != nil {
+				return nil, err
+			}
+			value := dynamodb.AttributeValue{}
+			err = json.Unmarshal(data, &value)
+			if err != nil {
+				return nil, newErrSerializeException(fmt.Sprintf("cannot decode attribute %s", name), err)
+			}
+			unpacked[name] = &value
+		}
+	}
+	return unpacked, nil
+}
+
+// decompress decompresses the attribute name, compressed with the compressor named codec.
+func (p *packer) decompress(name string, codec string, data []byte) ([]byte, error) {
+	if p.compressor == nil || codec != p.compressor.Name() {
+		return nil, newErrUnsupported(fmt.Sprintf("attribute %s is compressed with unknown compressor %q", name, codec))
+	}
+	data, err := p.compressor.Decompress(data)
+	if err != nil {
+		return nil, newErrSerializeException(fmt.Sprintf("cannot decompress attribute %s", name), err)
+	}
+	return data, nil
+}
+
+// orphanedBlob returns the blob referenced by the replaced item old but not by item, or an empty string.
+func orphanedBlob(old map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) string {
+	blob := old[blobField]
+	if blob == nil {
+		return ""
+	}
+	if current := item[blobField]; current != nil && aws.StringValue(current.S) == aws.StringValue(blob.S) {
+		return ""
+	}
+	return aws.StringValue(blob.S)
+}
+
+// remove deletes a blob which its item no longer references. Without a blob store, the blob is left as is.
+func (p *packer) remove(ctx context.Context, name string) error {
+	if p.blobs == nil {
+		return nil
+	}
+	err := p.blobs.Delete(ctx, name)
+	if err != nil {
+		return newErrBlobStore(fmt.Sprintf("cannot delete blob %s", name), err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package quickstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+type memBlobs map[string][]byte
+
+func (m memBlobs) Put(ctx context.Context, name string, data []byte) error {
+	m[name] = data
+	return nil
+}
+
+func (m memBlobs) Get(ctx context.Context, name string) ([]byte, error) {
+	return m[name], nil
+}
+
+func (m memBlobs) Delete(ctx context.Context, name string) error {
+	delete(m, name)
+	return nil
+}
+
+func TestPacker_Compress(t *testing.T) {
+	o := defaultOptions()
+	WithCompression(Gzip, 100, "body")(&o)
+	p := newPacker(o)
+	key := Key{Kind: "itm", Identifier: "1"}
+	avs := p.schema.attributes(key)
+	avs["body"] = &dynamodb.AttributeValue{S: aws.String(strings.Repeat("a", 1000))}
+	avs["title"] = &dynamodb.AttributeValue{S: aws.String(strings.Repeat("b", 1000))}
+
+	packed, err := p.pack(context.Background(), key, avs)
+	assert.NoError(t, err)
+	assert.NotNil(t, packed["body"].B)
+	assert.NotNil(t, packed["title"].S)
+	assert.Less(t, itemSize(packed), itemSize(avs))
+
+	unpacked, err := p.unpack(context.Background(), packed)
+	assert.NoError(t, err)
+	assert.Equal(t, avs, unpacked)
+}
+
+func TestPacker_Offload(t *testing.T) {
+	blobs := memBlobs{}
+	o := defaultOptions()
+	WithMaxItemSize(100)(&o)
+	WithBlobStore(blobs)(&o)
+	p := newPacker(o)
+	key := Key{Kind: "itm", Identifier: "1"}
+	avs := p.schema.attributes(key)
+	avs["body"] = &dynamodb.AttributeValue{S: aws.String(strings.Repeat("a", 1000))}
+
+	packed, err := p.pack(context.Background(), key, avs)
+	assert.NoError(t, err)
+	assert.Nil(t, packed["body"])
+	name := aws.StringValue(packed[blobField].S)
+	assert.True(t, strings.HasPrefix(name, key.String()+blobDelim))
+	assert.Len(t, blobs, 1)
+
+	// A new version of the item does not overwrite the blob of the previous one.
+	repacked, err := p.pack(context.Background(), key, avs)
+	assert.NoError(t, err)
+	assert.Equal(t, name, orphanedBlob(packed, repacked))
+	assert.Len(t, blobs, 2)
+	assert.NoError(t, p.remove(context.Background(), name))
+
+	unpacked, err := p.unpack(context.Background(), repacked)
+	assert.NoError(t, err)
+	assert.Equal(t, avs, unpacked)
+
+	assert.NoError(t, p.remove(context.Background(), aws.StringValue(repacked[blobField].S)))
+	assert.Len(t, blobs, 0)
+}
+
+func TestPacker_OrphanedBlob(t *testing.T) {
+	key := Key{Kind: "itm", Identifier: "1"}
+	offloaded := map[string]*dynamodb.AttributeValue{blobField: {S: aws.String(key.String())}}
+	inline := map[string]*dynamodb.AttributeValue{"body": {S: aws.String("a")}}
+
+	// An item updated to inline size, or deleted, no longer references its blob.
+	assert.Equal(t, key.String(), orphanedBlob(offloaded, inline))
+	assert.Equal(t, key.String(), orphanedBlob(offloaded, nil))
+	// An item written again with the same blob, as when a write is retried, keeps it.
+	assert.Equal(t, "", orphanedBlob(offloaded, offloaded))
+	// Items which were never offloaded leave nothing to delete.
+	assert.Equal(t, "", orphanedBlob(inline, nil))
+	assert.Equal(t, "", orphanedBlob(nil, nil))
+}
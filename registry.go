@@ -1,14 +1,88 @@
 package quickstore
 
-type registry struct {
-	kinds map[string]bool
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// KindRegistry records the kinds that keys can have. It is safe for concurrent use.
+type KindRegistry struct {
+	locker sync.RWMutex
+	kinds  map[string]reflect.Type
+}
+
+func NewKindRegistry() *KindRegistry {
+	return &KindRegistry{
+		kinds: make(map[string]reflect.Type),
+	}
+}
+
+// Register registers a kind, optionally with a prototype value of the type stored under it. A kind
+// cannot be a prefix of another, which would make legacy keys ambiguous. Registering a kind again
+// is allowed as long as the type is the same.
+func (r *KindRegistry) Register(kind string, prototype ...interface{}) error {
+	if kind == "" {
+		return newErrKindConflict(kind, "kind is empty")
+	}
+	if len(prototype) > 1 {
+		return newErrKindConflict(kind, "at most one prototype can be given")
+	}
+	var typ reflect.Type
+	if len(prototype) == 1 {
+		typ = indirectType(reflect.TypeOf(prototype[0]))
+	}
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	for existing, existingTyp := range r.kinds {
+		if existing == kind {
+			if existingTyp != typ {
+				return newErrKindConflict(kind, fmt.Sprintf("already registered with type %v", existingTyp))
+			}
+			return nil
+		}
+		if strings.HasPrefix(existing, kind) || strings.HasPrefix(kind, existing) {
+			return newErrKindConflict(kind, fmt.Sprintf("conflicts with registered kind %q", existing))
+		}
+	}
+	r.kinds[kind] = typ
+	return nil
+}
+
+func (r *KindRegistry) has(kind string) bool {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	_, ok := r.kinds[kind]
+	return ok
+}
+
+// typeOf returns the type registered for kind, or nil if the kind has no type.
+func (r *KindRegistry) typeOf(kind string) reflect.Type {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return r.kinds[kind]
 }
 
-func (r *registry) Register(kind string) {
-	r.kinds[kind] = true
+// check returns an error if the kind has a registered type and value is neither of it nor a pointer to it.
+func (r *KindRegistry) check(kind string, value interface{}) error {
+	typ := r.typeOf(kind)
+	if typ == nil {
+		return nil
+	}
+	actual := indirectType(reflect.TypeOf(value))
+	if actual != typ {
+		return newErrTypeMismatch(kind, typ, actual)
+	}
+	return nil
 }
 
-var Registry = registry{
-	kinds: make(map[string]bool),
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
 }
 
+// Registry is the registry used by Parse, ParseKey and stores created without WithRegistry.
+var Registry = NewKindRegistry()
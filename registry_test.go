@@ -0,0 +1,50 @@
+package quickstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewKindRegistry()
+
+	assert.NoError(t, r.Register("prj"))
+	assert.NoError(t, r.Register("prj"))
+	assert.NoError(t, r.Register("itm", Item{}))
+	assert.NoError(t, r.Register("itm", &Item{}))
+
+	assert.IsType(t, &ErrKindConflict{}, r.Register(""))
+	assert.IsType(t, &ErrKindConflict{}, r.Register("pr"))
+	assert.IsType(t, &ErrKindConflict{}, r.Register("prjx"))
+	assert.IsType(t, &ErrKindConflict{}, r.Register("prj", Item{}))
+}
+
+func TestRegistry_Check(t *testing.T) {
+	r := NewKindRegistry()
+	assert.NoError(t, r.Register("prj"))
+	assert.NoError(t, r.Register("itm", Item{}))
+
+	assert.NoError(t, r.check("prj", "anything"))
+	assert.NoError(t, r.check("itm", Item{}))
+	assert.NoError(t, r.check("itm", &Item{}))
+	assert.IsType(t, &ErrTypeMismatch{}, r.check("itm", map[string]string{}))
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	r := NewKindRegistry()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			kind := fmt.Sprintf("k%02d", i)
+			assert.NoError(t, r.Register(kind))
+			assert.True(t, r.has(kind))
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, r.kinds, 16)
+}
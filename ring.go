@@ -0,0 +1,54 @@
+package quickstore
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash"
+)
+
+// replicas is the number of points of each node on the ring. More points spread keys more evenly.
+const replicas = 64
+
+// ring places keys on nodes by consistent hashing: each node owns the arcs ending at its points, so adding or
+// removing a node only moves the keys of the arcs it gains or loses.
+type ring struct {
+	points []uint64
+	owners []int
+}
+
+func newRing(numNodes int) *ring {
+	r := &ring{
+		points: make([]uint64, 0, numNodes*replicas),
+		owners: make([]int, 0, numNodes*replicas),
+	}
+	owner := make(map[uint64]int)
+	for i := 0; i < numNodes; i++ {
+		for j := 0; j < replicas; j++ {
+			point := xxhash.Sum64String(strconv.Itoa(i) + "-" + strconv.Itoa(j))
+			if _, ok := owner[point]; ok {
+				continue
+			}
+			owner[point] = i
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	for _, point := range r.points {
+		r.owners = append(r.owners, owner[point])
+	}
+	return r
+}
+
+func (r *ring) owner(h string) int {
+	hash := xxhash.Sum64String(h)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
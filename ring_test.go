@@ -0,0 +1,64 @@
+package quickstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Moves(t *testing.T) {
+	small, large := newRing(16), newRing(64)
+	count := make([]int, 64)
+	moved := 0
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		h := strconv.Itoa(i)
+		from, to := small.owner(h), large.owner(h)
+		count[to]++
+		if from != to {
+			moved++
+			assert.GreaterOrEqual(t, to, 16, "keys only move to new nodes")
+		}
+	}
+	assert.InDelta(t, keys*3/4, moved, keys/10)
+	for i, c := range count {
+		assert.InDelta(t, keys/64, c, keys/64, "node %d", i)
+	}
+}
+
+func TestStore_Resize(t *testing.T) {
+	s, err := NewStore(nil, "test", WithNodes(4))
+	assert.NoError(t, err)
+	items := make(map[Key]*dynamodb.AttributeValue)
+	for i := 0; i < 100; i++ {
+		key := Key{Kind: "itm", Identifier: strconv.Itoa(i)}
+		items[key] = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+			"n": {N: aws.String(strconv.Itoa(i))},
+		}}
+		s.nodes[s.nodeOf(key)].adopt(key, cacheValue{state: stateExist, avs: items[key].M})
+	}
+
+	for _, size := range []int{16, 3} {
+		assert.NoError(t, s.Resize(context.Background(), size))
+		assert.Len(t, s.nodes, size)
+		for key, item := range items {
+			// Entries are found in the cache of their new node, without reading DynamoDB.
+			got, err := s.Get(context.Background(), key)
+			assert.NoError(t, err)
+			assert.Equal(t, item, got)
+		}
+	}
+	assert.NoError(t, s.Close(context.Background()))
+
+	// A closed store does not grow new nodes.
+	err = s.Resize(context.Background(), 8)
+	assert.True(t, errors.Is(err, SentinelClosed))
+	assert.Len(t, s.nodes, 3)
+	_, err = s.Upsert(Key{Kind: "itm", Identifier: "1"}, map[string]string{})
+	assert.True(t, errors.Is(err, SentinelClosed))
+}
@@ -0,0 +1,106 @@
+package quickstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// snapshotEntry is a line of a snapshot. Attributes are encoded as a map attribute value in the DynamoDB JSON
+// format, as exported mutations are.
+type snapshotEntry struct {
+	Key    Key             `json:"key"`
+	Exists bool            `json:"exists"`
+	Avs    json.RawMessage `json:"avs,omitempty"`
+}
+
+// SaveCache writes the cache to the file at path, as JSON Lines, for LoadCache to read it back in a later
+// process. Entries holding a mutation not flushed yet are left out. Entries are written as they are cached,
+// so the attributes encrypted with WithEncryption stay encrypted. The file is replaced atomically.
+func (s *Store) SaveCache(path string) error {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.saveCache(path)
+}
+
+func (s *Store) saveCache(path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, n := range s.nodes {
+		for key, entry := range n.snapshot() {
+			record := snapshotEntry{Key: key, Exists: entry.state == stateExist}
+			if record.Exists {
+				record.Avs, err = marshalAttribute(&dynamodb.AttributeValue{M: entry.avs})
+				if err != nil {
+					return newErrSerializeException("cannot marshal cache entry", err)
+				}
+			}
+			err = enc.Encode(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadCache fills the cache with the entries saved by SaveCache. Keys already cached keep their entry.
+// Restored entries are as recent as when they were saved: items written since by another process are read
+// stale until they are evicted, so a snapshot is only safe to load when this store is the only writer.
+func (s *Store) LoadCache(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for line := 1; ; line++ {
+		var entry snapshotEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newErrSerializeException(fmt.Sprintf("cannot decode cache entry at line %d", line), err)
+		}
+		value := cacheValue{state: stateNotExist}
+		if entry.Exists {
+			var avs dynamodb.AttributeValue
+			err = json.Unmarshal(entry.Avs, &avs)
+			if err == nil && avs.M == nil {
+				err = fmt.Errorf("entry exists but has no attributes")
+			}
+			if err != nil {
+				return newErrSerializeException(fmt.Sprintf("cannot decode cache entry at line %d", line), err)
+			}
+			value = cacheValue{state: stateExist, avs: avs.M}
+		}
+		s.nodes[s.nodeOf(entry.Key)].restore(entry.Key, value)
+	}
+}
@@ -0,0 +1,73 @@
+package quickstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_CacheSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quickstore-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.jsonl")
+
+	existing := generateKey()
+	deleted := generateKey()
+	dirty := generateKey()
+	avs := map[string]*dynamodb.AttributeValue{"name": {S: aws.String("First Name")}}
+	s := unreachableStore(t, WithCacheSnapshot(path))
+	defer s.Close(context.Background())
+	s.nodes[s.nodeOf(existing)].adopt(existing, cacheValue{state: stateExist, avs: avs})
+	s.nodes[s.nodeOf(deleted)].adopt(deleted, cacheValue{state: stateNotExist})
+	n := s.nodes[s.nodeOf(dirty)]
+	n.locker.Lock()
+	n.cache.markDirty(dirty, 1)
+	n.cache.Add(dirty, cacheValue{state: stateExist, avs: avs})
+	n.locker.Unlock()
+	assert.NoError(t, s.SaveCache(path))
+
+	restored := unreachableStore(t, WithCacheSnapshot(path), WithNodes(3))
+	defer restored.Close(context.Background())
+	item, err := restored.Get(context.Background(), existing)
+	assert.NoError(t, err)
+	assert.Equal(t, avs, item.M)
+	_, err = restored.Get(context.Background(), deleted)
+	assert.IsType(t, &ErrItemNotExisted{}, err)
+	_, ok := restored.nodes[restored.nodeOf(dirty)].cached(dirty)
+	assert.False(t, ok)
+}
+
+func TestStore_CacheSnapshotErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quickstore-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A corrupt snapshot is ignored.
+	corrupt := filepath.Join(dir, "corrupt.jsonl")
+	assert.NoError(t, ioutil.WriteFile(corrupt, []byte("{"), 0600))
+	s := unreachableStore(t, WithCacheSnapshot(corrupt))
+	assert.NoError(t, s.Close(context.Background()))
+
+	// Close reports both the unflushed mutations and the snapshot it could not save.
+	s = unreachableStore(t, WithCacheSnapshot(filepath.Join(dir, "missing", "cache.jsonl")))
+	_, err = s.Upsert(generateKey(), firstItem)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Close(ctx)
+	var unflushed *ErrUnflushed
+	assert.True(t, errors.As(err, &unflushed))
+	assert.Len(t, unflushed.Mutations(), 1)
+	assert.Error(t, unflushed.SnapshotErr())
+	assert.Contains(t, err.Error(), "cannot save cache snapshot")
+	assert.Equal(t, unflushed.Error(), unflushed.String())
+}
@@ -0,0 +1,249 @@
+package quickstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// spilledMutation is a line of the spill file. Attributes are encoded as a map attribute value in the DynamoDB
+// JSON format, as exported mutations are.
+type spilledMutation struct {
+	Op  opCode          `json:"op"`
+	Seq Seq             `json:"seq"`
+	Key Key             `json:"key"`
+	Avs json.RawMessage `json:"avs"`
+}
+
+// spill is a FIFO of mutations backed by a file, used when the in-memory queue is full. Mutations are pushed
+// under the node lock, but the file is only written by a background writer and read by the flusher outside
+// of it, so that reads on the node never wait for the disk. When writing fails, the mutations not written
+// stay in memory and are read from there, and later pushes are refused.
+type spill struct {
+	dir string
+	// len counts the mutations pushed and not read yet. It is guarded by the node lock.
+	len int
+
+	// mu guards the fields below, and cond signals their changes.
+	mu      sync.Mutex
+	cond    sync.Cond
+	pending []mutation
+	unread  int
+	err     error
+	closing bool
+	done    chan struct{}
+
+	// io guards the files.
+	io     sync.Mutex
+	wfile  *os.File
+	rfile  *os.File
+	writer *bufio.Writer
+	reader *bufio.Reader
+}
+
+func newSpill(dir string) *spill {
+	s := &spill{dir: dir}
+	s.cond.L = &s.mu
+	return s
+}
+
+func (s *spill) empty() bool {
+	return s.len == 0
+}
+
+// push hands the mutation to the writer. It fails once writing the file has failed.
+func (s *spill) push(mut mutation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.done == nil {
+		s.done = make(chan struct{})
+		go s.run()
+	}
+	s.pending = append(s.pending, mut)
+	s.len++
+	s.cond.Broadcast()
+	return nil
+}
+
+// run writes the pending mutations to the file, until the spill is closed or writing fails.
+func (s *spill) run() {
+	defer close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.pending) == 0 && !s.closing {
+			s.cond.Wait()
+		}
+		if len(s.pending) == 0 {
+			return
+		}
+		batch := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		err := s.write(batch)
+		s.mu.Lock()
+		if err != nil {
+			// Lines written before the failure are never read, as reads stop after the unread ones.
+			s.err = err
+			s.pending = append(batch, s.pending...)
+			s.cond.Broadcast()
+			return
+		}
+		s.unread += len(batch)
+		s.cond.Broadcast()
+	}
+}
+
+func (s *spill) write(batch []mutation) error {
+	s.io.Lock()
+	defer s.io.Unlock()
+	if s.wfile == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	for _, mut := range batch {
+		avs, err := marshalAttribute(&dynamodb.AttributeValue{M: mut.avs})
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(spilledMutation{Op: mut.op, Seq: mut.seq, Key: mut.key, Avs: avs})
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if _, err := s.writer.Write(b); err != nil {
+			return err
+		}
+	}
+	return s.writer.Flush()
+}
+
+func (s *spill) open() error {
+	wfile, err := ioutil.TempFile(s.dir, "quickstore-spill-*")
+	if err != nil {
+		return err
+	}
+	// Reads and writes happen at different offsets, hence two handles on the same file.
+	rfile, err := os.Open(wfile.Name())
+	if err != nil {
+		wfile.Close()
+		os.Remove(wfile.Name())
+		return err
+	}
+	s.wfile = wfile
+	s.rfile = rfile
+	s.writer = bufio.NewWriter(wfile)
+	s.reader = bufio.NewReader(rfile)
+	return nil
+}
+
+// read returns at most max mutations, in the order they were pushed, waiting for the writer if none is
+// written yet. The caller must know that mutations are left, and subtract the returned ones from len.
+func (s *spill) read(max int) ([]mutation, error) {
+	s.mu.Lock()
+	for s.unread == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.unread == 0 {
+		n := len(s.pending)
+		if n > max {
+			n = max
+		}
+		muts := append([]mutation(nil), s.pending[:n]...)
+		s.pending = s.pending[n:]
+		s.mu.Unlock()
+		return muts, nil
+	}
+	s.mu.Unlock()
+
+	// Only the flusher reads, so the unread mutations are still there once io is held.
+	s.io.Lock()
+	defer s.io.Unlock()
+	s.mu.Lock()
+	n := s.unread
+	if n > max {
+		n = max
+	}
+	s.mu.Unlock()
+
+	muts := make([]mutation, 0, n)
+	var err error
+	for len(muts) < n {
+		var line []byte
+		line, err = s.reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var spilled spilledMutation
+		if err = json.Unmarshal(line, &spilled); err != nil {
+			break
+		}
+		var avs dynamodb.AttributeValue
+		if err = json.Unmarshal(spilled.Avs, &avs); err != nil {
+			break
+		}
+		muts = append(muts, mutation{op: spilled.Op, seq: spilled.Seq, key: spilled.Key, avs: avs.M})
+	}
+
+	s.mu.Lock()
+	s.unread -= len(muts)
+	reset := s.unread == 0 && s.err == nil
+	s.mu.Unlock()
+	if err != nil {
+		return muts, err
+	}
+	// Everything written is read, so the file can start over. The writer waits for io meanwhile.
+	if reset {
+		return muts, s.reset()
+	}
+	return muts, nil
+}
+
+func (s *spill) reset() error {
+	if err := s.wfile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.wfile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := s.rfile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader.Reset(s.rfile)
+	return nil
+}
+
+// close stops the writer and removes the file. Mutations not read yet are lost.
+func (s *spill) close() error {
+	s.mu.Lock()
+	s.closing = true
+	s.cond.Broadcast()
+	done := s.done
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+
+	s.io.Lock()
+	defer s.io.Unlock()
+	if s.wfile == nil {
+		return nil
+	}
+	name := s.wfile.Name()
+	s.rfile.Close()
+	if err := s.wfile.Close(); err != nil {
+		return err
+	}
+	s.wfile = nil
+	s.rfile = nil
+	return os.Remove(name)
+}
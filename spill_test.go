@@ -0,0 +1,58 @@
+package quickstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpill_PushPop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quickstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := newSpill(dir)
+	defer s.close()
+
+	names := []string{"first", "second", "third"}
+	for i := 0; i < 2; i++ {
+		for _, name := range names {
+			err := s.push(mutation{
+				op:  opUpsert,
+				avs: map[string]*dynamodb.AttributeValue{"name": {S: aws.String(name)}},
+			})
+			assert.NoError(t, err)
+		}
+		var muts []mutation
+		for len(muts) < len(names) {
+			read, err := s.read(len(names))
+			assert.NoError(t, err)
+			muts = append(muts, read...)
+			s.len -= len(read)
+		}
+		for i, mut := range muts {
+			assert.Equal(t, opUpsert, mut.op)
+			assert.Equal(t, names[i], *mut.avs["name"].S)
+		}
+		assert.True(t, s.empty())
+	}
+}
+
+func TestSpill_KeepsMutationsItCannotWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quickstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := newSpill(filepath.Join(dir, "missing"))
+	defer s.close()
+
+	assert.NoError(t, s.push(mutation{op: opUpsert, seq: 1}))
+	muts, err := s.read(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []mutation{{op: opUpsert, seq: 1}}, muts)
+	// Once writing fails, mutations are refused rather than kept in memory.
+	assert.Error(t, s.push(mutation{op: opUpsert, seq: 2}))
+}
@@ -2,61 +2,186 @@ package quickstore
 
 import (
 	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/cespare/xxhash"
 )
 
 const (
-	numNodes       = 16
-	bufSize        = 1 << 16
-	flushThreshold = 20
+	defaultNumNodes = 16
+	bufSize         = 1 << 16
+	flushThreshold  = 20
 )
 
+// Seq identifies a mutation. Sequence numbers are increasing across the whole store.
+type Seq uint64
+
 type Store struct {
-	nodes [numNodes]*node
+	seq uint64
+
+	// locker guards nodes, ring and closed. Operations hold it for reading, so Resize holding it for writing
+	// waits for them and keeps new ones out while keys move.
+	locker sync.RWMutex
+	nodes  []*node
+	ring   *ring
+	closed bool
+	// routing holds a snapshot of nodes and ring for the reads of cached items, which take no lock. Keys
+	// moved by Resize leave the cache of their former node before the snapshot is replaced.
+	routing atomic.Value
+
+	client    *dynamodb.DynamoDB
+	table     string
+	opts      options
+	registry  *KindRegistry
+	schema    keySchema
+	encryptor *encryptor
+	codecs    codecs
 }
 
-func NewStore(client *dynamodb.DynamoDB, table string) (*Store, error) {
-	var nodes [numNodes]*node
+func NewStore(client *dynamodb.DynamoDB, table string, opts ...Option) (*Store, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.compositeKey && o.keyEncoding != KeyEncodingV1 {
+		return nil, newErrUnsupported("composite keys require KeyEncodingV1")
+	}
+	if o.numNodes < 1 {
+		return nil, newErrUnsupported("a store needs at least one node")
+	}
+	if o.getConcurrency < 1 {
+		return nil, newErrUnsupported("GetMulti needs a concurrency of at least one")
+	}
+	s := &Store{
+		nodes:     make([]*node, o.numNodes),
+		ring:      newRing(o.numNodes),
+		client:    client,
+		table:     table,
+		opts:      o,
+		registry:  o.registry,
+		schema:    o.schema(),
+		encryptor: newEncryptor(o),
+		codecs:    newCodecs(o),
+	}
 	var err error
-	for i := 0; i < numNodes; i++ {
-		nodes[i], err = newNode(client, table, bufSize, flushThreshold)
+	for i := range s.nodes {
+		s.nodes[i], err = s.newNode()
 		if err != nil {
 			return nil, err
 		}
 	}
-	s := &Store{
-		nodes: nodes,
+	s.routing.Store(routing{nodes: s.nodes, ring: s.ring})
+	if o.snapshotPath != "" {
+		// The snapshot only spares reads: when it is missing or corrupt, the cache is filled by reads instead,
+		// and Close replaces the file.
+		_ = s.LoadCache(o.snapshotPath)
 	}
 	return s, nil
 }
 
-func (s *Store) Insert(key Key, value interface{}) error {
+func (s *Store) Insert(key Key, value interface{}) (Seq, error) {
+	err := s.registry.check(key.Kind, value)
+	if err != nil {
+		return 0, err
+	}
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if s.closed {
+		return 0, newErrClosed()
+	}
 	return s.nodes[s.nodeOf(key)].insert(key, value)
 }
 
-func (s *Store) Upsert(key Key, value interface{}) error {
+func (s *Store) Upsert(key Key, value interface{}) (Seq, error) {
+	err := s.registry.check(key.Kind, value)
+	if err != nil {
+		return 0, err
+	}
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if s.closed {
+		return 0, newErrClosed()
+	}
 	return s.nodes[s.nodeOf(key)].upsert(key, value)
 }
 
-func (s *Store) Update(key Key, value interface{}) error {
+func (s *Store) Update(key Key, value interface{}) (Seq, error) {
+	err := s.registry.check(key.Kind, value)
+	if err != nil {
+		return 0, err
+	}
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if s.closed {
+		return 0, newErrClosed()
+	}
 	return s.nodes[s.nodeOf(key)].update(key, value)
 }
 
-func (s *Store) Delete(key Key) error {
+func (s *Store) Delete(key Key) (Seq, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if s.closed {
+		return 0, newErrClosed()
+	}
 	return s.nodes[s.nodeOf(key)].delete(key)
 }
 
 func (s *Store) Get(ctx context.Context, key Key) (*dynamodb.AttributeValue, error) {
+	av, err := s.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(ctx, key, av)
+}
+
+// get serves cached items without taking any lock, through the routing snapshot. Misses go to the node
+// under the read lock.
+func (s *Store) get(ctx context.Context, key Key) (*dynamodb.AttributeValue, error) {
+	r := s.routing.Load().(routing)
+	if cached, ok := r.nodes[r.ring.owner(s.placement(key))].cached(key); ok {
+		return itemOf(key, cached)
+	}
+	s.locker.RLock()
+	defer s.locker.RUnlock()
 	return s.nodes[s.nodeOf(key)].get(ctx, key)
 }
 
+// GetValue gets an item and decodes it with the codec of the key's kind into a new value of the type registered
+// for that kind.
+// The returned value is a pointer to that type.
+func (s *Store) GetValue(ctx context.Context, key Key) (interface{}, error) {
+	typ := s.registry.typeOf(key.Kind)
+	if typ == nil {
+		return nil, newErrUntypedKind(key.Kind)
+	}
+	av, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	value := reflect.New(typ)
+	err = s.codecs.of(key.Kind).Unmarshal(av.M, value.Interface())
+	if err != nil {
+		return nil, newErrSerializeException("cannot unmarshal item", err)
+	}
+	return value.Interface(), nil
+}
+
+// GetMulti gets the items of keys which exist. Nodes are read concurrently, with at most the number of
+// requests set by WithGetConcurrency in flight. When some keys cannot be read, the items read are returned
+// together with an ErrPartialResult telling why the other keys failed.
 func (s *Store) GetMulti(ctx context.Context, keys map[Key]bool) (map[Key]*dynamodb.AttributeValue, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
 	items := make(map[Key]*dynamodb.AttributeValue)
-	var p [numNodes]map[Key]bool
+	failed := make(map[Key]error)
+	p := make([]map[Key]bool, len(s.nodes))
 
-	for i := 0; i < numNodes; i++ {
+	for i := range p {
 		p[i] = make(map[Key]bool)
 	}
 
@@ -64,26 +189,76 @@ func (s *Store) GetMulti(ctx context.Context, keys map[Key]bool) (map[Key]*dynam
 		p[s.nodeOf(key)][key] = true
 	}
 
-	for i := 0; i < numNodes; i++ {
+	sem := make(chan struct{}, s.opts.getConcurrency)
+	var wg sync.WaitGroup
+	var locker sync.Mutex
+	for i := range p {
 		if len(p[i]) == 0 {
 			continue
 		}
-		output, err := s.nodes[i].getMulti(ctx, p[i])
+		wg.Add(1)
+		go func(n *node, keys map[Key]bool) {
+			defer wg.Done()
+			output, nodeFailed := n.getMulti(ctx, keys, sem)
+			for key, item := range output {
+				item, err := s.decrypt(ctx, key, item)
+				if err != nil {
+					nodeFailed[key] = err
+					delete(output, key)
+					continue
+				}
+				output[key] = item
+			}
+			locker.Lock()
+			defer locker.Unlock()
+			for key, item := range output {
+				items[key] = item
+			}
+			for key, err := range nodeFailed {
+				failed[key] = err
+			}
+		}(s.nodes[i], p[i])
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return items, newErrPartialResult(failed)
+	}
+	return items, nil
+}
+
+// GetTree gets an item and all of its descendants with a single query. It requires WithCompositeKey.
+// Pending mutations of the tree are flushed first, so the result reflects every mutation made before the call.
+func (s *Store) GetTree(ctx context.Context, key Key) (map[Key]*dynamodb.AttributeValue, error) {
+	if !s.schema.composite {
+		return nil, newErrUnsupported("GetTree requires composite keys")
+	}
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	n := s.nodes[s.nodeOf(key)]
+	seq := Seq(atomic.LoadUint64(&s.seq))
+	n.requestFlush(seq)
+	err := n.waitFlushed(ctx, seq)
+	if err != nil {
+		return nil, err
+	}
+	items, err := n.getTree(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for itemKey, item := range items {
+		items[itemKey], err = s.decrypt(ctx, itemKey, item)
 		if err != nil {
 			return nil, err
 		}
-		for key, item := range output {
-			items[key] = item
-		}
 	}
-
 	return items, nil
 }
 
 func (s *Store) DoesItemExist(ctx context.Context, key Key) (bool, error) {
-	_, err := s.nodes[s.nodeOf(key)].get(ctx, key)
+	_, err := s.get(ctx, key)
 	if err != nil {
-		if _, ok := err.(ErrItemNotExisted); ok {
+		if errors.Is(err, SentinelItemNotExisted) {
 			return false, nil
 		}
 		return false, err
@@ -91,15 +266,213 @@ func (s *Store) DoesItemExist(ctx context.Context, key Key) (bool, error) {
 	return true, nil
 }
 
+// WaitFlushed waits until every mutation with a sequence number up to seq is written to DynamoDB.
+// Mutations rejected by DynamoDB with an error that is not retryable are not retried; WaitFlushed then
+// returns an ErrUnflushed listing them, whose cause tells why they were rejected. Every call covering a rejected
+// mutation reports it, until a later mutation of the same key is written. When ctx is done first, it returns an
+// ErrTimeout, as reads do.
+func (s *Store) WaitFlushed(ctx context.Context, seq Seq) error {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	for _, n := range s.nodes {
+		n.requestFlush(seq)
+	}
+	for _, n := range s.nodes {
+		err := n.waitFlushed(ctx, seq)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes out every mutation made so far and waits for it.
+func (s *Store) Flush(ctx context.Context) error {
+	return s.WaitFlushed(ctx, Seq(atomic.LoadUint64(&s.seq)))
+}
+
+// Replay re-applies mutations written by ExportMutations, in order. Insertions and updates are applied
+// as upserts, so replaying mutations that were partially flushed is safe. It returns the sequence number
+// of the last replayed mutation, which can be passed to WaitFlushed.
+func (s *Store) Replay(r io.Reader) (Seq, error) {
+	muts, err := ImportMutations(r)
+	if err != nil {
+		return 0, err
+	}
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	if s.closed {
+		return 0, newErrClosed()
+	}
+	var last Seq
+	for _, mut := range muts {
+		op := opUpsert
+		if mut.Op == OpDelete {
+			op = opDelete
+		}
+		seq, err := s.nodes[s.nodeOf(mut.Key)].apply(mut.Key, op, mut.Item)
+		if err != nil {
+			return last, err
+		}
+		last = seq
+	}
+	return last, nil
+}
+
+// Close stops accepting mutations and waits for the pending ones to be flushed. When ctx is done first,
+// flushing is given up and the returned ErrUnflushed lists the mutations that were not written.
+// With WithCacheSnapshot, the cache is then saved; if that fails as well, ErrUnflushed.SnapshotErr reports it.
+func (s *Store) Close(ctx context.Context) error {
+	s.locker.Lock()
+	s.closed = true
+	s.locker.Unlock()
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	for _, n := range s.nodes {
+		n.close()
+	}
+	for _, n := range s.nodes {
+		select {
+		case <-n.done:
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		for _, n := range s.nodes {
+			n.abort()
+		}
+	}
+	var unflushed []mutation
+	var cause error
+	for _, n := range s.nodes {
+		<-n.done
+		n.locker.Lock()
+		if muts := n.unflushed; len(muts) > 0 {
+			unflushed = append(unflushed, muts...)
+			if cause == nil {
+				cause = n.err
+			}
+		}
+		n.locker.Unlock()
+	}
+	var err error
+	if s.opts.snapshotPath != "" {
+		err = s.saveCache(s.opts.snapshotPath)
+	}
+	if len(unflushed) > 0 {
+		unflushedErr := newErrUnflushed(exportMutations(unflushed), cause)
+		unflushedErr.snapshotErr = err
+		return unflushedErr
+	}
+	return err
+}
+
+// CloseAndWait waits indefinitely for the pending mutations and drops any error.
+//
+// Deprecated: use Close instead.
 func (s *Store) CloseAndWait() {
-	for i := 0; i < numNodes; i++ {
-		s.nodes[i].close()
+	_ = s.Close(context.Background())
+}
+
+// decrypt decrypts the attributes encrypted with WithEncryption. Items are cached encrypted, so this happens
+// on every read, but the encryptor caches the data keys, so only the first read of an item calls the key provider.
+func (s *Store) decrypt(ctx context.Context, key Key, av *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	avs, err := s.encryptor.decrypt(ctx, key, av.M)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.AttributeValue{M: avs}, nil
+}
+
+// Resize changes the number of nodes of a live store. Pending mutations are flushed first, so that the writes
+// of a key never come from two nodes, then the cached entries and failed mutations of the keys changing node
+// move to their new node. Keys are placed by consistent hashing, so only the keys of the added or removed
+// nodes change node. Other operations wait for Resize to complete. A closed store returns ErrClosed.
+func (s *Store) Resize(ctx context.Context, numNodes int) error {
+	if numNodes < 1 {
+		return newErrUnsupported("a store needs at least one node")
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.closed {
+		return newErrClosed()
+	}
+	if numNodes == len(s.nodes) {
+		return nil
+	}
+
+	seq := Seq(atomic.LoadUint64(&s.seq))
+	for _, n := range s.nodes {
+		n.requestFlush(seq)
+	}
+	for _, n := range s.nodes {
+		// Failed mutations are not pending anymore, they move with their keys without being reported.
+		err := n.waitThrough(ctx, seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	nodes := make([]*node, numNodes)
+	copy(nodes, s.nodes)
+	for i := len(s.nodes); i < numNodes; i++ {
+		n, err := s.newNode()
+		if err != nil {
+			for _, n := range nodes[len(s.nodes):i] {
+				n.close()
+			}
+			return err
+		}
+		nodes[i] = n
 	}
-	for i := 0; i < numNodes; i++ {
-		<-s.nodes[i].done
+	r := newRing(numNodes)
+	leaving := func(i int) func(Key) bool {
+		return func(key Key) bool {
+			return r.owner(s.placement(key)) != i
+		}
+	}
+	for i, n := range s.nodes {
+		entries, failed, cause := n.evacuate(leaving(i))
+		for key, entry := range entries {
+			nodes[r.owner(s.placement(key))].adopt(key, entry)
+		}
+		for _, mut := range failed {
+			nodes[r.owner(s.placement(mut.key))].adoptFailed(mut, cause)
+		}
 	}
+	if numNodes < len(s.nodes) {
+		for _, n := range s.nodes[numNodes:] {
+			n.close()
+			<-n.done
+		}
+	}
+	s.nodes = nodes
+	s.ring = r
+	s.routing.Store(routing{nodes: nodes, ring: r})
+	return nil
+}
+
+type routing struct {
+	nodes []*node
+	ring  *ring
+}
+
+func (s *Store) newNode() (*node, error) {
+	return newNode(s.client, s.table, bufSize, flushThreshold, &s.seq, s.opts)
 }
 
 func (s *Store) nodeOf(key Key) int {
-	return int(xxhash.Sum64String(key.String()) % uint64(len(s.nodes)))
+	return s.ring.owner(s.placement(key))
+}
+
+// placement returns what places the key on a node. Every key of a tree is placed with its root when keys are
+// composite, so that the tree can be flushed and read together.
+func (s *Store) placement(key Key) string {
+	if s.schema.composite {
+		// Keys that do not resolve are rejected when encoded, wherever they are placed.
+		key, _ = s.schema.resolve(key)
+		root, _ := splitRoot(key)
+		return root
+	}
+	return key.String()
 }
@@ -2,18 +2,28 @@ package quickstore
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/stretchr/testify/assert"
 )
 
-var store *Store
+var (
+	store    *Store
+	registry = NewKindRegistry()
+)
 
 type Item struct {
 	Name    string `json:"name"`
@@ -42,7 +52,7 @@ var (
 
 func TestStore_Insert(t *testing.T) {
 	withContext(func(ctx context.Context) {
-		err := store.Insert(firstKey, firstItem)
+		_, err := store.Insert(firstKey, firstItem)
 		assert.NoError(t, err)
 
 		av, err := store.Get(ctx, firstKey)
@@ -54,25 +64,25 @@ func TestStore_Insert(t *testing.T) {
 
 		assert.Equal(t, firstItem, actual)
 
-		err = store.Delete(firstKey)
+		_, err = store.Delete(firstKey)
 		assert.NoError(t, err)
 	})
 }
 
 func TestStore_InsertTwice(t *testing.T) {
-	err := store.Insert(firstKey, firstItem)
+	_, err := store.Insert(firstKey, firstItem)
 	assert.NoError(t, err)
 
-	err = store.Insert(firstKey, secondItem)
+	_, err = store.Insert(firstKey, secondItem)
 	assert.IsType(t, err, &ErrItemExisted{})
 
-	err = store.Delete(firstKey)
+	_, err = store.Delete(firstKey)
 	assert.NoError(t, err)
 }
 
 func TestStore_Upsert(t *testing.T) {
 	withContext(func(ctx context.Context) {
-		err := store.Upsert(secondKey, secondItem)
+		_, err := store.Upsert(secondKey, secondItem)
 		assert.NoError(t, err)
 
 		av, err := store.Get(ctx, secondKey)
@@ -84,31 +94,49 @@ func TestStore_Upsert(t *testing.T) {
 
 		assert.Equal(t, secondItem, actual)
 
-		err = store.Delete(secondKey)
+		_, err = store.Delete(secondKey)
 		assert.NoError(t, err)
 	})
 }
 
 func TestStore_UpsertTwice(t *testing.T) {
-	err := store.Upsert(thirdKey, thirdItem)
+	_, err := store.Upsert(thirdKey, thirdItem)
 	assert.NoError(t, err)
 
-	err = store.Upsert(thirdKey, firstItem)
+	_, err = store.Upsert(thirdKey, firstItem)
 	assert.NoError(t, err)
 
-	err = store.Delete(thirdKey)
+	_, err = store.Delete(thirdKey)
 	assert.NoError(t, err)
 }
 
+func TestStore_DoesItemExist(t *testing.T) {
+	withContext(func(ctx context.Context) {
+		exists, err := store.DoesItemExist(ctx, generateKey())
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
+		_, err = store.Upsert(secondKey, secondItem)
+		assert.NoError(t, err)
+
+		exists, err = store.DoesItemExist(ctx, secondKey)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		_, err = store.Delete(secondKey)
+		assert.NoError(t, err)
+	})
+}
+
 func TestStore_GetMulti(t *testing.T) {
 	withContext(func(ctx context.Context) {
-		err := store.Insert(firstKey, firstItem)
+		_, err := store.Insert(firstKey, firstItem)
 		assert.NoError(t, err)
 
-		err = store.Insert(secondKey, secondItem)
+		_, err = store.Insert(secondKey, secondItem)
 		assert.NoError(t, err)
 
-		err = store.Insert(thirdKey, thirdItem)
+		_, err = store.Insert(thirdKey, thirdItem)
 		assert.NoError(t, err)
 
 		items, err := store.GetMulti(ctx, map[Key]bool{firstKey: true, secondKey: true, thirdKey: true})
@@ -131,6 +159,201 @@ func TestStore_GetMulti(t *testing.T) {
 	})
 }
 
+func TestStore_GetValue(t *testing.T) {
+	withContext(func(ctx context.Context) {
+		err := registry.Register("itm", Item{})
+		assert.NoError(t, err)
+
+		_, err = store.Upsert(firstKey, map[string]string{"name": "First Name"})
+		assert.IsType(t, &ErrTypeMismatch{}, err)
+
+		_, err = store.Upsert(firstKey, firstItem)
+		assert.NoError(t, err)
+
+		value, err := store.GetValue(ctx, firstKey)
+		assert.NoError(t, err)
+		assert.Equal(t, &firstItem, value)
+
+		_, err = store.Delete(firstKey)
+		assert.NoError(t, err)
+	})
+}
+
+func TestStore_WaitFlushed(t *testing.T) {
+	withContext(func(ctx context.Context) {
+		seq, err := store.Upsert(firstKey, firstItem)
+		assert.NoError(t, err)
+
+		err = store.WaitFlushed(ctx, seq)
+		assert.NoError(t, err)
+
+		_, err = store.Delete(firstKey)
+		assert.NoError(t, err)
+
+		err = store.Flush(ctx)
+		assert.NoError(t, err)
+	})
+}
+
+func TestStore_GetMultiPartial(t *testing.T) {
+	s := unreachableStore(t, WithNodes(4), WithGetConcurrency(2))
+	defer s.Close(context.Background())
+
+	keys := make(map[Key]bool)
+	cached := make(map[Key]bool)
+	for i := 0; i < 20; i++ {
+		key := Key{Kind: "itm", Identifier: strconv.Itoa(i)}
+		keys[key] = true
+		if i%2 == 0 {
+			cached[key] = true
+			s.nodes[s.nodeOf(key)].adopt(key, cacheValue{state: stateExist, avs: map[string]*dynamodb.AttributeValue{}})
+		}
+	}
+
+	items, err := s.GetMulti(context.Background(), keys)
+	var partial *ErrPartialResult
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, items, len(cached))
+	assert.Len(t, partial.Failed(), len(keys)-len(cached))
+	for key := range partial.Failed() {
+		assert.False(t, cached[key])
+	}
+}
+
+func TestStore_GetMultiBacksOffUnprocessedKeys(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var input struct {
+			RequestItems json.RawMessage
+		}
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{"Responses":{},"UnprocessedKeys":` + string(input.RequestItems) + `}`))
+	}))
+	defer server.Close()
+	s := storeAt(t, server.URL, WithNodes(1))
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	_, err := s.GetMulti(ctx, map[Key]bool{generateKey(): true, generateKey(): true})
+	var partial *ErrPartialResult
+	assert.True(t, errors.As(err, &partial))
+	for _, err := range partial.Failed() {
+		assert.True(t, errors.Is(err, SentinelTimeout))
+	}
+	// Requests are sent after 0 and 100 milliseconds, the next one would be after the deadline.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestStore_GetMultiWaitsForRead(t *testing.T) {
+	s := unreachableStore(t)
+	defer s.Close(context.Background())
+	key := generateKey()
+	n := s.nodes[s.nodeOf(key)]
+	n.locker.Lock()
+	n.cache.Add(key, cacheValue{state: stateBusy})
+	n.flights.start(key)
+	n.locker.Unlock()
+
+	done := make(chan map[Key]*dynamodb.AttributeValue)
+	go func() {
+		items, err := s.GetMulti(context.Background(), map[Key]bool{key: true})
+		assert.NoError(t, err)
+		done <- items
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("GetMulti did not wait for the read in flight")
+	default:
+	}
+
+	avs := map[string]*dynamodb.AttributeValue{"name": {S: aws.String("read")}}
+	n.locker.Lock()
+	n.cache.Add(key, cacheValue{state: stateExist, avs: avs})
+	n.flights.finish(key)
+	n.locker.Unlock()
+	assert.Equal(t, avs, (<-done)[key].M)
+}
+
+func TestStore_GetHonoursContext(t *testing.T) {
+	s := unreachableStore(t)
+	defer s.Close(context.Background())
+	key := generateKey()
+	n := s.nodes[s.nodeOf(key)]
+	n.locker.Lock()
+	n.cache.Add(key, cacheValue{state: stateBusy})
+	n.flights.start(key)
+	n.locker.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := s.Get(ctx, key)
+	assert.True(t, errors.Is(err, SentinelTimeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	n.locker.Lock()
+	n.flights.finish(key)
+	n.locker.Unlock()
+}
+
+func TestStore_WaitFlushedHonoursContext(t *testing.T) {
+	s := unreachableStore(t)
+	seq, err := s.Upsert(generateKey(), firstItem)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.WaitFlushed(ctx, seq)
+	assert.True(t, errors.Is(err, SentinelTimeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// The write is still being retried, so Close gives it up.
+	closeCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(s.Close(closeCtx), SentinelUnflushed))
+}
+
+func TestStore_FlushStopsRetryingRejectedWrites(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException","message":"rejected"}`))
+	}))
+	defer server.Close()
+	s := storeAt(t, server.URL, WithNodes(1))
+
+	_, err := s.Upsert(generateKey(), firstItem)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Flush(ctx)
+	assert.True(t, errors.Is(err, SentinelUnflushed))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+// unreachableStore returns a store whose reads and writes to DynamoDB fail at once.
+func unreachableStore(t *testing.T, opts ...Option) *Store {
+	return storeAt(t, "http://127.0.0.1:1", opts...)
+}
+
+// storeAt returns a store sending its requests to DynamoDB to endpoint, without retrying them in the SDK.
+func storeAt(t *testing.T, endpoint string, opts ...Option) *Store {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ap-southeast-2"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	s, err := NewStore(dynamodb.New(sess), "quickstore-test", opts...)
+	assert.NoError(t, err)
+	return s
+}
+
 func generateKey() Key {
 	return Key{
 		Parent:     "",
@@ -149,14 +372,19 @@ func beforeAll() {
 	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("ap-southeast-2")}))
 	client := dynamodb.New(sess)
 	var err error
-	store, err = NewStore(client, "quickstore-test")
+	store, err = NewStore(client, "quickstore-test", WithRegistry(registry))
 	if err != nil {
 		panic(err)
 	}
 }
 
 func afterAll() {
-	store.CloseAndWait()
+	withContext(func(ctx context.Context) {
+		err := store.Close(ctx)
+		if err != nil {
+			panic(err)
+		}
+	})
 }
 
 func TestMain(m *testing.M) {
@@ -0,0 +1,191 @@
+package quickstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const defaultWarmRate = 25
+
+// Warm reads the keys into the cache, so that their first reads do not reach DynamoDB, for instance after a
+// restart. Keys already cached are skipped, the others are read in batches of up to 100 keys of the same node,
+// at the rate set with WithWarmRate. Keys which could not be read are reported by an ErrPartialResult.
+func (s *Store) Warm(ctx context.Context, keys map[Key]bool) error {
+	var batches []map[Key]bool
+	s.locker.RLock()
+	byNode := make([]map[Key]bool, len(s.nodes))
+	for key := range keys {
+		i := s.nodeOf(key)
+		if byNode[i] == nil {
+			byNode[i] = make(map[Key]bool)
+		}
+		byNode[i][key] = true
+		if len(byNode[i]) == getMultiThreshold {
+			batches = append(batches, byNode[i])
+			byNode[i] = nil
+		}
+	}
+	s.locker.RUnlock()
+	for _, batch := range byNode {
+		if batch != nil {
+			batches = append(batches, batch)
+		}
+	}
+
+	lim := newLimiter(s.opts.warmRate)
+	defer lim.stop()
+	failed := make(map[Key]error)
+	for _, batch := range batches {
+		err := lim.wait(ctx)
+		if err != nil {
+			return err
+		}
+		for key, err := range s.warm(ctx, batch) {
+			failed[key] = err
+		}
+	}
+	if len(failed) > 0 {
+		return newErrPartialResult(failed)
+	}
+	return nil
+}
+
+// warm reads a batch of keys into the cache. The store lock is only held per batch, so that Resize is not
+// held back by a long warm up; keys may then have changed node since the batches were made.
+func (s *Store) warm(ctx context.Context, batch map[Key]bool) map[Key]error {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	byNode := make(map[*node]map[Key]bool)
+	for key := range batch {
+		n := s.nodes[s.nodeOf(key)]
+		if byNode[n] == nil {
+			byNode[n] = make(map[Key]bool)
+		}
+		byNode[n][key] = true
+	}
+	failed := make(map[Key]error)
+	sem := make(chan struct{}, 1)
+	for n, keys := range byNode {
+		for key, err := range n.warm(ctx, keys, sem) {
+			failed[key] = err
+		}
+	}
+	return failed
+}
+
+// WarmKind reads every item of kind into the cache, with a scan of the table reading pages of up to 100 items
+// at the rate set with WithWarmRate. The scan goes through the whole table, the items of other kinds are
+// filtered out by DynamoDB but still consume read capacity. The scan is eventually consistent, which halves its
+// cost: cached items are never replaced, but an item written just before the scan and evicted since may be
+// cached in its previous version. It requires KeyEncodingV1.
+func (s *Store) WarmKind(ctx context.Context, kind string) error {
+	if s.schema.encoding != KeyEncodingV1 {
+		return newErrUnsupported("WarmKind requires KeyEncodingV1")
+	}
+	// The last segment of the key, "/kind:identifier", holds the kind of the item.
+	input := dynamodb.ScanInput{
+		TableName:                &s.table,
+		Limit:                    aws.Int64(getMultiThreshold),
+		FilterExpression:         aws.String("contains(#k, :k)"),
+		ExpressionAttributeNames: map[string]*string{"#k": aws.String(keyField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":k": {S: aws.String(string(segDelim) + escape(kind) + string(kindDelim))},
+		},
+	}
+	if s.schema.composite {
+		input.FilterExpression = aws.String("contains(#k, :k) OR contains(#s, :k)")
+		input.ExpressionAttributeNames["#s"] = aws.String(sortField)
+	}
+
+	lim := newLimiter(s.opts.warmRate)
+	defer lim.stop()
+	for {
+		err := lim.wait(ctx)
+		if err != nil {
+			return err
+		}
+		output, err := s.scanPage(ctx, kind, &input)
+		if err != nil {
+			return err
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// scanPage scans a page of items and caches those of kind. The store lock is held for the page, so that the
+// nodes tracking the keys mutated during the scan are the ones caching its items.
+func (s *Store) scanPage(ctx context.Context, kind string, input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	for _, n := range s.nodes {
+		n.beginScan()
+	}
+	defer func() {
+		for _, n := range s.nodes {
+			n.endScan()
+		}
+	}()
+	output, err := s.client.ScanWithContext(ctx, input)
+	if err != nil {
+		return nil, newErrFromDynamoDB(err)
+	}
+	return output, s.preload(ctx, kind, output.Items)
+}
+
+// preload caches the scanned items of kind.
+func (s *Store) preload(ctx context.Context, kind string, items []map[string]*dynamodb.AttributeValue) error {
+	for _, item := range items {
+		key, err := s.schema.decode(item)
+		if err != nil {
+			return err
+		}
+		// The filter also matches ancestors of that kind.
+		if key.Kind != kind {
+			continue
+		}
+		err = s.nodes[s.nodeOf(key)].preload(ctx, key, item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limiter spaces requests to at most rate per second. A rate below one does not limit.
+type limiter struct {
+	ticker *time.Ticker
+}
+
+func newLimiter(rate int) *limiter {
+	if rate < 1 {
+		return &limiter{}
+	}
+	return &limiter{ticker: time.NewTicker(time.Second / time.Duration(rate))}
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l.ticker == nil {
+		if ctx.Err() != nil {
+			return newErrTimeout(ctx.Err())
+		}
+		return nil
+	}
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return newErrTimeout(ctx.Err())
+	}
+}
+
+func (l *limiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
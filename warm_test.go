@@ -0,0 +1,87 @@
+package quickstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Warm(t *testing.T) {
+	s := unreachableStore(t, WithNodes(2))
+	defer s.Close(context.Background())
+
+	keys := make(map[Key]bool)
+	for i := 0; i < 4; i++ {
+		key := Key{Kind: "itm", Identifier: strconv.Itoa(i)}
+		keys[key] = true
+		s.nodes[s.nodeOf(key)].adopt(key, cacheValue{state: stateExist, avs: map[string]*dynamodb.AttributeValue{}})
+	}
+	assert.NoError(t, s.Warm(context.Background(), keys))
+
+	missing := generateKey()
+	keys[missing] = true
+	err := s.Warm(context.Background(), keys)
+	var partial *ErrPartialResult
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Failed(), 1)
+	assert.Contains(t, partial.Failed(), missing)
+}
+
+func TestStore_WarmKeepsRecency(t *testing.T) {
+	s := unreachableStore(t, WithCache(New2QCache))
+	defer s.Close(context.Background())
+	key := generateKey()
+	n := s.nodes[s.nodeOf(key)]
+	n.adopt(key, cacheValue{state: stateExist, avs: map[string]*dynamodb.AttributeValue{}})
+
+	assert.NoError(t, s.Warm(context.Background(), map[Key]bool{key: true}))
+	// A second access would have promoted the key to the frequent queue.
+	cache := n.cache.cache.(*twoQueueCache)
+	assert.True(t, cache.recent.Contains(key))
+	assert.False(t, cache.frequent.Contains(key))
+}
+
+func TestNode_PreloadSkipsTouchedKeys(t *testing.T) {
+	s := unreachableStore(t, WithNodes(1))
+	defer s.Close(context.Background())
+	n := s.nodes[0]
+	touched := Key{Kind: "itm", Identifier: "touched"}
+	untouched := Key{Kind: "itm", Identifier: "untouched"}
+
+	n.beginScan()
+	// The key is flushed, then evicted, after the scan read it.
+	n.locker.Lock()
+	n.touch(touched)
+	n.locker.Unlock()
+	for _, key := range []Key{touched, untouched} {
+		assert.NoError(t, n.preload(context.Background(), key, n.schema.attributes(key)))
+	}
+	n.endScan()
+
+	_, ok := n.cache.Peek(touched)
+	assert.False(t, ok)
+	_, ok = n.cache.Peek(untouched)
+	assert.True(t, ok)
+	assert.Nil(t, n.touched)
+}
+
+func TestLimiter(t *testing.T) {
+	lim := newLimiter(100)
+	defer lim.stop()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, lim.wait(context.Background()))
+	}
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := newLimiter(0).wait(ctx)
+	assert.True(t, errors.Is(err, SentinelTimeout))
+	assert.True(t, errors.Is(err, context.Canceled))
+}